@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+conditionFuncs returns the functions available in the if attribute of commands and code blocks,
+in addition to the functions of Go templates like eq, not, and and or:
+
+	os               the operating system mdx runs on, like linux or darwin
+	arch             the architecture mdx runs on, like amd64 or arm64
+	env "NAME"       the value of the environment variable NAME, or "" if it is not set
+	exists "PATH"    whether PATH exists, relative to the working directory of the code block
+	probe "COMMAND"  whether the shell command COMMAND exits with status 0
+
+Files and probe commands are resolved in dir.
+*/
+func conditionFuncs(ctx context.Context, dir string) template.FuncMap {
+	return template.FuncMap{
+		"os":   func() string { return runtime.GOOS },
+		"arch": func() string { return runtime.GOARCH },
+		"env":  os.Getenv,
+		"exists": func(path string) bool {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			_, err := os.Stat(path)
+			return err == nil
+		},
+		"probe": func(command string) bool {
+			cmd := exec.CommandContext(ctx, "sh", "-c", command)
+			cmd.Dir = dir
+			cmd.Env = codeBlockEnv(ctx, cmd)
+			err := cmd.Run()
+			logrus.Debug(fmt.Sprintf("Probe '%s' returned: %v", command, err))
+			return err == nil
+		},
+	}
+}
+
+/*
+evaluateCondition evaluates the if attribute in meta, which belongs to commandBlock or to one of its code blocks.
+The condition is a Go template pipeline, like 'eq os "linux"' or 'and (exists "go.mod") (probe "command -v go")',
+which is true unless it evaluates to false, 0, nil or an empty value. It can use the data of templateData and
+the functions of templateFuncs. Without an if attribute, the condition is true.
+*/
+func evaluateCondition(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, meta map[string]any, args ...string) (bool, error) {
+	condition, ok := metaString(meta, "if")
+	if !ok {
+		return true, nil
+	}
+
+	dir, err := workingDirectory(commandBlock, codeBlock)
+	if err != nil {
+		return false, err
+	}
+	code := conditionTemplate(condition)
+	fields, err := templateFields(code, "", "")
+	if err != nil {
+		return false, fmt.Errorf("%w: if=%s: %v", ErrInvalidAttribute, condition, err)
+	}
+	tmpl, err := template.New("if").Funcs(templateFuncs(ctx, dir)).Funcs(conditionFuncs(ctx, dir)).Option("missingkey=error").Parse(code)
+	if err != nil {
+		return false, fmt.Errorf("%w: if=%s: %v", ErrInvalidAttribute, condition, err)
+	}
+
+	var result bytes.Buffer
+	if err := tmpl.Execute(&result, templateData(ctx, commandBlock, args, fields)); err != nil {
+		return false, fmt.Errorf("%w: if=%s: %v", ErrInvalidAttribute, condition, err)
+	}
+	logrus.Debug(fmt.Sprintf("Condition '%s' of command '%s' is %v", condition, commandBlock.Name, result.String() == "true"))
+	return result.String() == "true", nil
+}
+
+// conditionTemplate returns the template which evaluates the if attribute condition to "true".
+func conditionTemplate(condition string) string {
+	return "{{if " + condition + "}}true{{end}}"
+}
+
+// skipCommand records that commandBlock was not executed for reason, without executing its dependencies.
+func (s *runState) skipCommand(commandBlock *CommandBlock, reason string) {
+	logrus.Info(fmt.Sprintf("Skipping command '%s': %s", commandBlock.Name, reason))
+	s.mu.Lock()
+	for i := range commandBlock.CodeBlocks {
+		s.skipped = append(s.skipped, blockResult{command: commandBlock, codeBlock: &commandBlock.CodeBlocks[i]})
+	}
+	s.mu.Unlock()
+
+	skipped := commandEvent(eventCommandSkipped, commandBlock)
+	skipped.Reason = reason
+	s.emit(skipped)
+}
+
+// skipBlock records that codeBlock of commandBlock was not executed for reason.
+func (s *runState) skipBlock(commandBlock *CommandBlock, codeBlock *CodeBlock, reason string) {
+	logrus.Info(fmt.Sprintf("Skipping code block '%s' in line %d of command '%s': %s", codeBlock.Lang, codeBlock.Line, commandBlock.Name, reason))
+	s.mu.Lock()
+	s.skipped = append(s.skipped, blockResult{command: commandBlock, codeBlock: codeBlock})
+	s.mu.Unlock()
+
+	skipped := blockEvent(eventBlockSkipped, commandBlock, codeBlock)
+	skipped.Reason = reason
+	s.emit(skipped)
+}
+
+// getSkipped returns the code blocks which were skipped because of their condition.
+func (s *runState) getSkipped() []blockResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]blockResult{}, s.skipped...)
+}
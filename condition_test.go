@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MDX_TEST_FEATURE", "on")
+	command := &CommandBlock{Name: "test", Meta: map[string]any{"dir": dir}}
+
+	tests := []struct {
+		name      string
+		condition string
+		args      []string
+		want      bool
+		wantErr   error
+	}{
+		{"OS", `eq os "` + runtime.GOOS + `"`, nil, true, nil},
+		{"OtherOS", `eq os "plan9"`, nil, false, nil},
+		{"Arch", `eq arch "` + runtime.GOARCH + `"`, nil, true, nil},
+		{"Env", `eq (env "MDX_TEST_FEATURE") "on"`, nil, true, nil},
+		{"EnvNotSet", `env "MDX_TEST_NOT_SET"`, nil, false, nil},
+		{"Exists", `exists "go.mod"`, nil, true, nil},
+		{"NotExists", `not (exists "package.json")`, nil, true, nil},
+		{"Probe", `probe "test -f go.mod"`, nil, true, nil},
+		{"ProbeFails", `probe "exit 1"`, nil, false, nil},
+		{"Arg", `eq .arg1 "prod"`, []string{"prod"}, true, nil},
+		{"Combined", `and (exists "go.mod") (ne os "plan9")`, nil, true, nil},
+		{"Invalid", `eq os "linux`, nil, false, ErrInvalidAttribute},
+		{"UnknownFunction", `windows`, nil, false, ErrInvalidAttribute},
+		{"MissingArg", `.arg1`, nil, false, ErrInvalidAttribute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := map[string]any{"if": tt.condition}
+			got, err := evaluateCondition(context.Background(), command, &CodeBlock{}, meta, tt.args...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("evaluateCondition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("evaluateCondition() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := evaluateCondition(context.Background(), command, &CodeBlock{}, map[string]any{}); !got || err != nil {
+		t.Errorf("evaluateCondition() without condition = %v, %v, want true", got, err)
+	}
+}
+
+func TestExecuteCommandBlock_Conditions(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"setup": {
+			Name:       "setup",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "echo setup", Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{},
+		},
+		"plan9": {
+			Name:         "plan9",
+			Dependencies: []string{"setup"},
+			CodeBlocks:   []CodeBlock{{Lang: "sh", Code: "echo plan9", Meta: map[string]any{"shebang": false}}},
+			Meta:         map[string]any{"if": `eq os "plan9"`},
+		},
+		"install": {
+			Name:         "install",
+			Dependencies: []string{"plan9"},
+			CodeBlocks: []CodeBlock{
+				{Lang: "sh", Code: "echo linux", Line: 3, Meta: map[string]any{"shebang": false, "if": `eq os "plan9"`}},
+				{Lang: "sh", Code: "echo everywhere", Line: 7, Meta: map[string]any{"shebang": false}},
+			},
+			Meta: map[string]any{},
+		},
+	}
+
+	handler := &recordedEvents{}
+	command := commands["install"]
+	output, err := captureOutput(func() error {
+		state := newRunState()
+		state.events = handler
+		return executeCommandBlock(withRunState(context.Background(), state), commands, &command)
+	})
+	if err != nil {
+		t.Fatalf("executeCommandBlock() error = %v", err)
+	}
+	if output != "everywhere\n" {
+		t.Errorf("output = %q, want only the unconditional code block", output)
+	}
+
+	var got []string
+	for _, e := range handler.events {
+		if e.Type == eventCommandSkipped || e.Type == eventBlockSkipped {
+			got = append(got, string(e.Type)+" "+e.Command+": "+e.Reason)
+		}
+	}
+	want := []string{
+		`CommandSkipped plan9: condition 'eq os "plan9"' is false`,
+		`BlockSkipped install: condition 'eq os "plan9"' is false`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("skipped events = %q, want %q", got, want)
+	}
+}
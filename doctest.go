@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// match modes of output fences
+const (
+	matchExact      = "exact"
+	matchRegex      = "regex"
+	matchWhitespace = "ws"
+)
+
+// doctest is the outcome of testing one command against its output fences.
+type doctest struct {
+	command  *CommandBlock
+	duration time.Duration
+	failures []string      // descriptions of the failed expectations
+	outdated []blockResult // results of code blocks whose output does not match, used to update the expectations
+}
+
+// hasExpectations reports whether a code block of the command is followed by an output fence.
+func hasExpectations(command *CommandBlock) bool {
+	for _, codeBlock := range command.CodeBlocks {
+		if codeBlock.Output != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// withTrailingNewline returns s ending with a newline, like the content of a code fence.
+func withTrailingNewline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
+
+/*
+matchOutput reports whether output matches the output fence expected. The match attribute of the
+fence selects how they are compared:
+- exact (default): the output is equal to the content of the fence
+- regex: the content of the fence is a regular expression matching the whole output
+- ws: the output is equal to the content of the fence, ignoring differences in whitespace
+*/
+func matchOutput(expected *OutputFence, output string) (bool, error) {
+	mode := expected.Meta["match"]
+	switch mode {
+	case "", matchExact:
+		return withTrailingNewline(output) == expected.Content, nil
+	case matchRegex:
+		pattern := strings.TrimSuffix(expected.Content, "\n")
+		re, err := regexp.Compile(`\A(?:` + pattern + `)\z`)
+		if err != nil {
+			return false, fmt.Errorf("%w: match=regex: %v", ErrInvalidAttribute, err)
+		}
+		return re.MatchString(strings.TrimSuffix(output, "\n")), nil
+	case matchWhitespace:
+		return strings.Join(strings.Fields(output), " ") == strings.Join(strings.Fields(expected.Content), " "), nil
+	default:
+		return false, fmt.Errorf("%w: match=%s: expected '%s', '%s' or '%s'", ErrInvalidAttribute, mode, matchExact, matchRegex, matchWhitespace)
+	}
+}
+
+// expectedExitCode returns the exit code expected by the exit attribute of the output fence, if it is set.
+func expectedExitCode(expected *OutputFence) (int, bool, error) {
+	value, ok := expected.Meta["exit"]
+	if !ok {
+		return 0, false, nil
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: exit=%s: expected an exit code", ErrInvalidAttribute, value)
+	}
+	return code, true, nil
+}
+
+/*
+diffLines returns a line-based diff turning want into got. Removed lines are prefixed with "-",
+added lines with "+" and unchanged lines with " ".
+*/
+func diffLines(want, got string) string {
+	a := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff.WriteString(" " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
+}
+
+/*
+checkExpectation compares the result of a code block with its output fence and returns a description
+of the mismatch, or an empty string if the result matches. Secrets are masked in the output before
+it is compared, like in the output fences written by writeOutputs.
+*/
+func checkExpectation(codeBlock *CodeBlock, result blockResult) (string, error) {
+	var mismatches []string
+
+	code, ok, err := expectedExitCode(codeBlock.Output)
+	if err != nil {
+		return "", err
+	}
+	if ok && code != result.exitCode {
+		mismatches = append(mismatches, fmt.Sprintf("exit status %d, expected %d", result.exitCode, code))
+	}
+
+	output := redactions.redact(string(result.output))
+	matches, err := matchOutput(codeBlock.Output, output)
+	if err != nil {
+		return "", err
+	}
+	if !matches {
+		diff := diffLines(codeBlock.Output.Content, output)
+		mismatches = append(mismatches, fmt.Sprintf("%v (-expected +actual):\n%s", ErrOutputMismatch, diff))
+	}
+
+	return strings.Join(mismatches, "\n"), nil
+}
+
+/*
+runDoctest executes the command without arguments and compares the output of its code blocks
+with the output fences below them. The output of the command is not written to the stdout of mdx.
+A code block may fail if its output fence expects its exit status with the exit attribute.
+*/
+func runDoctest(ctx context.Context, commands map[string]CommandBlock, command *CommandBlock) (doctest, error) {
+	test := doctest{command: command}
+
+	state := newRunState()
+	state.recordOutput = true
+	state.stdout = io.Discard
+	state.stderr = io.Discard
+
+	start := time.Now()
+	err := executeCommandBlock(withRunState(ctx, state), commands, command)
+	test.duration = time.Since(start)
+	if errors.Is(err, ErrInterrupted) {
+		return test, err
+	}
+
+	results := make(map[int]blockResult)
+	for _, result := range state.getResults() {
+		if result.command.Name == command.Name && result.command.Filename == command.Filename {
+			results[result.codeBlock.Source.Start] = result
+		}
+	}
+
+	skipped := make(map[int]bool)
+	for _, result := range state.getSkipped() {
+		if result.command.Name == command.Name && result.command.Filename == command.Filename {
+			skipped[result.codeBlock.Source.Start] = true
+		}
+	}
+
+	explained := false
+	for i := range command.CodeBlocks {
+		codeBlock := &command.CodeBlocks[i]
+		if codeBlock.Output == nil {
+			continue
+		}
+		result, ok := results[codeBlock.Source.Start]
+		if !ok && skipped[codeBlock.Source.Start] {
+			// the expected output does not apply, e.g. on another operating system
+			continue
+		}
+		if !ok {
+			test.failures = append(test.failures, fmt.Sprintf("line %d: code block was not executed", codeBlock.Line))
+			continue
+		}
+
+		mismatch, checkErr := checkExpectation(codeBlock, result)
+		if checkErr != nil {
+			test.failures = append(test.failures, fmt.Sprintf("line %d: %v", codeBlock.Line, checkErr))
+			continue
+		}
+		if mismatch != "" {
+			test.failures = append(test.failures, fmt.Sprintf("line %d: %s", codeBlock.Line, mismatch))
+			if codeBlock.Output.Meta["match"] != matchRegex {
+				test.outdated = append(test.outdated, result)
+			}
+			continue
+		}
+		if _, expectsExit := codeBlock.Output.Meta["exit"]; expectsExit && result.err != nil {
+			explained = true
+		}
+	}
+
+	if err != nil && !explained {
+		test.failures = append(test.failures, err.Error())
+	}
+	return test, nil
+}
+
+// expectationAttributes updates the exit attribute of an output fence, if it is set or the code block failed.
+func expectationAttributes(result blockResult, attributes map[string]string) {
+	if _, ok := attributes["exit"]; ok || result.exitCode != 0 {
+		attributes["exit"] = strconv.Itoa(result.exitCode)
+	}
+}
+
+/*
+runTests tests all commands which have output fences and prints a report to w. Commands are tested
+in the order of their markdown files and lines. With update, the output fences of code blocks
+whose output does not match are replaced with the actual output, once all commands of the file
+were tested. A command is only reported as updated if all its output fences were replaced.
+*/
+func runTests(ctx context.Context, w io.Writer, commands map[string]CommandBlock, update bool) error {
+	var tested []*CommandBlock
+	for name := range commands {
+		command := commands[name]
+		if hasExpectations(&command) {
+			tested = append(tested, &command)
+		}
+	}
+	sort.Slice(tested, func(i, j int) bool {
+		if tested[i].Filename != tested[j].Filename {
+			return tested[i].Filename < tested[j].Filename
+		}
+		return tested[i].CodeBlocks[0].Line < tested[j].CodeBlocks[0].Line
+	})
+
+	// outdated expectations are only updated if they are the only failures of the command
+	updatable := func(test doctest) bool {
+		return update && len(test.outdated) > 0 && len(test.outdated) == len(test.failures)
+	}
+
+	passed, failed, updated := 0, 0, 0
+	for first := 0; first < len(tested); {
+		// the commands of a file are tested first, then their outdated outputs are written at once
+		last := first
+		for last < len(tested) && tested[last].Filename == tested[first].Filename {
+			last++
+		}
+		var tests []doctest
+		var outdated []blockResult
+		for _, command := range tested[first:last] {
+			logrus.Debug(fmt.Sprintf("Testing command '%s' in '%s'", command.Name, command.Filename))
+			test, err := runDoctest(ctx, commands, command)
+			if err != nil {
+				return err
+			}
+			if updatable(test) {
+				outdated = append(outdated, test.outdated...)
+			}
+			tests = append(tests, test)
+		}
+		first = last
+
+		written := make(map[int]bool)
+		if len(outdated) > 0 {
+			results, err := writeOutputs(outdated, expectationAttributes)
+			if err != nil {
+				return err
+			}
+			for _, result := range results {
+				written[result.codeBlock.Source.Start] = true
+			}
+		}
+
+		for _, test := range tests {
+			command := test.command
+			location := fmt.Sprintf("%s:%d", command.Filename, command.CodeBlocks[0].Line)
+			if updatable(test) {
+				applied := true
+				for _, result := range test.outdated {
+					if !written[result.codeBlock.Source.Start] {
+						applied = false
+						test.failures = append(test.failures, fmt.Sprintf("line %d: the output was not updated, the code block moved", result.codeBlock.Line))
+					}
+				}
+				if applied {
+					fmt.Fprintf(w, "UPDATE %s (%s)\n", command.Name, location)
+					updated++
+					continue
+				}
+			}
+			if len(test.failures) > 0 {
+				fmt.Fprintf(w, "FAIL   %s (%s)\n", command.Name, location)
+				for _, failure := range test.failures {
+					fmt.Fprintf(w, "    %s\n", strings.ReplaceAll(strings.TrimSuffix(failure, "\n"), "\n", "\n    "))
+				}
+				failed++
+				continue
+			}
+			fmt.Fprintf(w, "ok     %s (%s) %v\n", command.Name, location, test.duration.Round(time.Millisecond))
+			passed++
+		}
+	}
+
+	fmt.Fprintf(w, "%d passed, %d failed, %d updated\n", passed, failed, updated)
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d commands", ErrTestsFailed, failed, len(tested))
+	}
+	return nil
+}
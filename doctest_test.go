@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		match    string
+		expected string
+		output   string
+		want     bool
+		wantErr  error
+	}{
+		{"exact", "", "hello\n", "hello\n", true, nil},
+		{"exact without newline", "exact", "hello\n", "hello", true, nil},
+		{"exact mismatch", "", "hello\n", "hello world\n", false, nil},
+		{"regex", "regex", "v\\d+\\.\\d+\n", "v1.23\n", true, nil},
+		{"regex matches whole output", "regex", "v\\d+\n", "v1 and more\n", false, nil},
+		{"invalid regex", "regex", "(\n", "", false, ErrInvalidAttribute},
+		{"whitespace", "ws", "a b\nc\n", "a   b c", true, nil},
+		{"whitespace mismatch", "ws", "a b\n", "ab\n", false, nil},
+		{"unknown mode", "fuzzy", "a\n", "a\n", false, ErrInvalidAttribute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := &OutputFence{Content: tt.expected, Meta: map[string]string{}}
+			if tt.match != "" {
+				expected.Meta["match"] = tt.match
+			}
+			got, err := matchOutput(expected, tt.output)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("matchOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("matchOutput() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines("a\nb\nc\n", "a\nx\nc\nd\n")
+	want := " a\n-b\n+x\n c\n+d\n"
+	if got != want {
+		t.Errorf("diffLines() = %q, want %q", got, want)
+	}
+}
+
+const doctestSource = "## [hello]()\n\n```sh\necho hello\n```\n\n```output\nhello\n```\n\n" +
+	"## [fails]()\n\n```sh\necho oops\nexit 2\n```\n\n```output exit=2\noops\n```\n\n" +
+	"## [drifted]()\n\n```sh\necho new\n```\n\n```output\nold\n```\n"
+
+func TestRunTests(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	filename := filepath.Join(t.TempDir(), "doctest.md")
+	if err := os.WriteFile(filename, []byte(doctestSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(update bool) (string, error) {
+		commands := map[string]CommandBlock{}
+		if err := loadCommands(filename, commands); err != nil {
+			t.Fatalf("loadCommands() error = %v", err)
+		}
+		var report bytes.Buffer
+		err := runTests(context.Background(), &report, commands, update)
+		return report.String(), err
+	}
+
+	report, err := run(false)
+	if !errors.Is(err, ErrTestsFailed) {
+		t.Errorf("runTests() error = %v, wantErr %v", err, ErrTestsFailed)
+	}
+	for _, want := range []string{"ok     hello", "ok     fails", "FAIL   drifted", "-old\n    +new", "2 passed, 1 failed, 0 updated"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("runTests() report does not contain %q:\n%s", want, report)
+		}
+	}
+
+	if report, err := run(true); err != nil || !strings.Contains(report, "UPDATE drifted") {
+		t.Errorf("runTests() with update error = %v, report:\n%s", err, report)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(doctestSource, "old", "new", 1); string(data) != want {
+		t.Errorf("runTests() with update wrote\n%s\nwant\n%s", data, want)
+	}
+
+	if report, err := run(false); err != nil {
+		t.Errorf("runTests() after update error = %v, report:\n%s", err, report)
+	}
+}
+
+const doctestTwoOutdated = "## [one]()\n\n```sh\nprintf 'a\\nb\\nc\\n'\n```\n\n```output\na\n```\n\n## [two]()\n\n```sh\necho two\n```\n\n```output\nold\n```\n"
+
+func TestRunTests_UpdateTwoCommands(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	filename := filepath.Join(t.TempDir(), "doctest.md")
+	if err := os.WriteFile(filename, []byte(doctestTwoOutdated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(update bool) (string, error) {
+		commands := map[string]CommandBlock{}
+		if err := loadCommands(filename, commands); err != nil {
+			t.Fatalf("loadCommands() error = %v", err)
+		}
+		var report bytes.Buffer
+		err := runTests(context.Background(), &report, commands, update)
+		return report.String(), err
+	}
+
+	report, err := run(true)
+	if err != nil {
+		t.Fatalf("runTests() with update error = %v, report:\n%s", err, report)
+	}
+	for _, want := range []string{"UPDATE one", "UPDATE two", "0 passed, 0 failed, 2 updated"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("runTests() with update report does not contain %q:\n%s", want, report)
+		}
+	}
+
+	if report, err := run(false); err != nil || !strings.Contains(report, "2 passed, 0 failed, 0 updated") {
+		t.Errorf("runTests() after update error = %v, report:\n%s", err, report)
+	}
+}
+
+func TestRunTests_SecretMasked(t *testing.T) {
+	resetSecrets(t)
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	t.Setenv("DOCTEST_TOKEN", "s3cr3tvalue")
+	redactions.addValue("s3cr3tvalue")
+	filename := filepath.Join(t.TempDir(), "doctest.md")
+	source := "## [token]()\n\n```sh\necho \"token is $DOCTEST_TOKEN\"\n```\n\n```output\nold\n```\n"
+	if err := os.WriteFile(filename, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, update := range []bool{true, false} {
+		commands := map[string]CommandBlock{}
+		if err := loadCommands(filename, commands); err != nil {
+			t.Fatalf("loadCommands() error = %v", err)
+		}
+		var report bytes.Buffer
+		if err := runTests(context.Background(), &report, commands, update); err != nil {
+			t.Fatalf("runTests(update=%v) error = %v, report:\n%s", update, err, report.String())
+		}
+	}
+	content := readTestFile(t, filename)
+	if strings.Contains(content, "s3cr3tvalue") || !strings.Contains(content, "token is ***") {
+		t.Errorf("updated file = %q, want the secret to be masked", content)
+	}
+}
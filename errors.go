@@ -1,6 +1,11 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
 
 var (
 	ErrNoCommandFoundCommands       = errors.New("no command found in commands")
@@ -11,4 +16,57 @@ var (
 	ErrNoInfostringOrShebang        = errors.New("no infostring and no shebang defined")
 	ErrDuplicateCommand             = errors.New("duplicate command found")
 	ErrDependencyNotFound           = errors.New("dependency not found")
+	ErrInterrupted                  = errors.New("interrupted by signal")
+	ErrInvalidAttribute             = errors.New("invalid attribute")
+	ErrTimeout                      = errors.New("timeout exceeded")
+	ErrExecutionFailed              = errors.New("failed to execute command")
+	ErrRetriesExhausted             = errors.New("code block failed in all attempts")
+	ErrWorkDirNotFound              = errors.New("working directory not found")
+	ErrInvalidOutput                = errors.New("invalid output")
+	ErrOutputMismatch               = errors.New("output does not match the expected output")
+	ErrTestsFailed                  = errors.New("tests failed")
+	ErrHistoryEntryNotFound         = errors.New("history entry not found")
+	ErrServiceNotReady              = errors.New("service did not become ready")
+	ErrHandlerFailed                = errors.New("handler failed")
+	ErrDependencyCycle              = errors.New("dependency cycle")
+	ErrInvalidArguments             = errors.New("invalid arguments")
+	ErrInvalidTemplate              = errors.New("invalid template")
+	ErrSecretNotFound               = errors.New("secret not found")
+	ErrRerunNotPossible             = errors.New("invocation can not be repeated")
 )
+
+// signalError is the cancellation cause used when mdx receives a termination signal.
+type signalError struct {
+	sig os.Signal
+}
+
+func (e *signalError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrInterrupted, e.sig)
+}
+
+func (e *signalError) Unwrap() error {
+	return ErrInterrupted
+}
+
+// timeoutError is the cancellation cause used when a timeout of mdx, a command or a code block expires.
+type timeoutError struct {
+	scope   string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%v: %s did not finish within %v", ErrTimeout, e.scope, e.timeout)
+}
+
+func (e *timeoutError) Unwrap() error {
+	return ErrTimeout
+}
+
+// exitStatusError is returned when a code block executed in a session exits with a non-zero status.
+type exitStatusError struct {
+	status int
+}
+
+func (e *exitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", e.status)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventType is the type of an execution event.
+type eventType string
+
+// event types, in the order they occur during the execution of a command
+const (
+	eventCommandStarted  eventType = "CommandStarted"
+	eventBlockStarted    eventType = "BlockStarted"
+	eventBlockSkipped    eventType = "BlockSkipped"
+	eventOutputChunk     eventType = "OutputChunk"
+	eventBlockFinished   eventType = "BlockFinished"
+	eventCommandFinished eventType = "CommandFinished"
+	eventCommandFailed   eventType = "CommandFailed"
+	eventCommandSkipped  eventType = "CommandSkipped"
+)
+
+// event is emitted by the executor while commands are executed.
+type event struct {
+	Type     eventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	File     string    `json:"file,omitempty"`
+	Line     int       `json:"line,omitempty"`             // line of the code block
+	Lang     string    `json:"lang,omitempty"`             // language of the code block
+	Args     []string  `json:"args,omitempty"`             // arguments of the command, for CommandStarted
+	Stream   string    `json:"stream,omitempty"`           // "stdout" or "stderr", for OutputChunk
+	Data     string    `json:"data,omitempty"`             // the output, for OutputChunk
+	ExitCode *int      `json:"exit_code,omitempty"`        // exit code of the code block, for BlockFinished
+	Duration float64   `json:"duration_seconds,omitempty"` // for BlockFinished, CommandFinished and CommandFailed
+	Error    string    `json:"error,omitempty"`            // for failed code blocks and commands
+	Reason   string    `json:"reason,omitempty"`           // why the command or code block was skipped, for CommandSkipped and BlockSkipped
+}
+
+// eventHandler receives the events of an invocation. Events can be emitted concurrently.
+type eventHandler interface {
+	handleEvent(e event)
+}
+
+// jsonlEvents writes every event as a line of JSON.
+type jsonlEvents struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONLEvents(w io.Writer) *jsonlEvents {
+	return &jsonlEvents{encoder: json.NewEncoder(w)}
+}
+
+func (h *jsonlEvents) handleEvent(e event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.encoder.Encode(e)
+}
+
+/*
+parseEventsFlag parses the value of --events: "jsonl" writes the events to stdout,
+"jsonl=path" to the file at path. The returned path is empty for stdout.
+*/
+func parseEventsFlag(value string) (string, error) {
+	format, path, hasPath := strings.Cut(value, "=")
+	if format != "jsonl" {
+		return "", fmt.Errorf("unknown event format '%s': expected 'jsonl'", format)
+	}
+	if hasPath && path == "" {
+		return "", fmt.Errorf("expected jsonl or jsonl=path")
+	}
+	return path, nil
+}
+
+// commandEvent returns an event of type t for commandBlock.
+func commandEvent(t eventType, commandBlock *CommandBlock) event {
+	return event{Type: t, Command: commandBlock.Name, File: commandBlock.Filename}
+}
+
+// blockEvent returns an event of type t for codeBlock of commandBlock.
+func blockEvent(t eventType, commandBlock *CommandBlock, codeBlock *CodeBlock) event {
+	e := commandEvent(t, commandBlock)
+	e.Line = codeBlock.Line
+	e.Lang = codeBlock.Lang
+	return e
+}
+
+// blockFinishedEvent returns the BlockFinished event of a code block which returned err after duration.
+func blockFinishedEvent(commandBlock *CommandBlock, codeBlock *CodeBlock, duration time.Duration, err error) event {
+	e := blockEvent(eventBlockFinished, commandBlock, codeBlock)
+	code := exitCode(err)
+	e.ExitCode = &code
+	e.Duration = duration.Seconds()
+	e.Error = errorString(err)
+	return e
+}
+
+// chunkWriter emits everything written to it as OutputChunk events.
+type chunkWriter struct {
+	state  *runState
+	event  event
+	stream string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	e := w.event
+	e.Stream = w.stream
+	e.Data = string(p)
+	w.state.emit(e)
+	return len(p), nil
+}
+
+/*
+teeEvents returns writers which write to stdout and stderr and emit everything written as OutputChunk
+events of codeBlock. stdout and stderr are returned unchanged if no event handler is set.
+*/
+func (s *runState) teeEvents(commandBlock *CommandBlock, codeBlock *CodeBlock, stdout io.Writer, stderr io.Writer) (io.Writer, io.Writer) {
+	if s.events == nil {
+		return stdout, stderr
+	}
+	e := blockEvent(eventOutputChunk, commandBlock, codeBlock)
+	return io.MultiWriter(stdout, &chunkWriter{state: s, event: e, stream: "stdout"}),
+		io.MultiWriter(stderr, &chunkWriter{state: s, event: e, stream: "stderr"})
+}
+
+// emit passes e to the event handler of the invocation, if there is one, with secrets masked.
+func (s *runState) emit(e event) {
+	if s.events == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Args != nil {
+		e.Args = redactions.redactAll(e.Args)
+	}
+	e.Data = redactions.redact(e.Data)
+	e.Error = redactions.redact(e.Error)
+	e.Reason = redactions.redact(e.Reason)
+	s.events.handleEvent(e)
+}
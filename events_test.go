@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordedEvents records the events of an invocation for tests.
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []event
+}
+
+func (h *recordedEvents) handleEvent(e event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+}
+
+func TestExecuteCommandBlock_Events(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"build": {
+			Name:       "build",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "echo built", Line: 3, Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{},
+		},
+		"test": {
+			Name:         "test",
+			Dependencies: []string{"build"},
+			CodeBlocks:   []CodeBlock{{Lang: "sh", Code: "echo failed >&2; exit 1", Line: 9, Meta: map[string]any{"shebang": false}}},
+			Meta:         map[string]any{},
+		},
+		"deploy": {
+			Name:         "deploy",
+			Dependencies: []string{"test"},
+			CodeBlocks:   []CodeBlock{{Lang: "sh", Code: "echo deployed", Line: 15, Meta: map[string]any{"shebang": false}}},
+			Meta:         map[string]any{},
+		},
+	}
+
+	handler := &recordedEvents{}
+	command := commands["deploy"]
+	captureOutput(func() error {
+		state := newRunState()
+		state.events = handler
+		return executeCommandBlock(withRunState(context.Background(), state), commands, &command)
+	})
+
+	var got []string
+	for _, e := range handler.events {
+		got = append(got, string(e.Type)+" "+e.Command+" "+e.Stream+e.Data)
+	}
+	want := []string{
+		"CommandStarted build ",
+		"BlockStarted build ",
+		"OutputChunk build stdoutbuilt\n",
+		"BlockFinished build ",
+		"CommandFinished build ",
+		"CommandStarted test ",
+		"BlockStarted test ",
+		"OutputChunk test stderrfailed\n",
+		"BlockFinished test ",
+		"CommandFailed test ",
+		"CommandSkipped deploy ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	finished := handler.events[8]
+	if finished.ExitCode == nil || *finished.ExitCode != 1 || finished.Line != 9 {
+		t.Errorf("BlockFinished event = %+v, want exit code 1 in line 9", finished)
+	}
+	if skipped := handler.events[10]; skipped.Reason != "dependency 'test' failed" {
+		t.Errorf("CommandSkipped reason = %q", skipped.Reason)
+	}
+}
+
+func TestParseEventsFlag(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantPath string
+		wantErr  bool
+	}{
+		{"jsonl", "", false},
+		{"jsonl=events.jsonl", "events.jsonl", false},
+		{"jsonl=", "", true},
+		{"xml", "", true},
+	}
+
+	for _, tt := range tests {
+		path, err := parseEventsFlag(tt.value)
+		if (err != nil) != tt.wantErr || path != tt.wantPath {
+			t.Errorf("parseEventsFlag(%q) = %q, %v, want %q, error %v", tt.value, path, err, tt.wantPath, tt.wantErr)
+		}
+	}
+}
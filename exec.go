@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -29,6 +36,40 @@ type LauncherBlock struct {
 // the key is the infostring from the code fence
 var launchers = map[string]LauncherBlock{}
 
+// Settings contains the global execution settings, populated from the command line flags.
+type Settings struct {
+	GracePeriod     time.Duration // time between forwarding a signal to a code block and killing it
+	Timeout         time.Duration // timeout for the whole invocation of mdx, 0 disables the timeout
+	InvocationDir   string        // the directory mdx was started in
+	WorkDir         string        // the directory code blocks are executed in, if DirMode is dirModeInvocation
+	DirMode         string        // dirModeInvocation or dirModeFile
+	Reports         reportFlag    // reports to write after the command finished
+	Events          string        // "jsonl" or "jsonl=path" to write execution events, empty to disable them
+	Timings         bool          // print the durations of the executed commands after the command finished
+	Trace           string        // path to write a Chrome trace of the executed commands to
+	HistoryOutput   bool          // record the output of the code blocks in the history
+	LogFile         string        // path of the log file, may contain {command} to log every command to its own file
+	LogMaxSize      int64         // size in bytes after which the log file is rotated, 0 disables the rotation
+	LogMaxFiles     int           // number of rotated log files to keep
+	LogRedact       string        // regular expression matching secrets to mask in the log file and the messages of mdx
+	SecretsProvider string        // provider of secrets referenced without provider prefix, see secretProviders
+	SecretsDir      string        // directory of the secrets of the file provider
+	SecretsFile     string        // encrypted file of the secrets of the age and gpg providers
+	SecretsCommand  string        // command printing the secret named by its argument, for the exec provider
+}
+
+const (
+	dirModeInvocation = "invocation" // execute code blocks in settings.WorkDir
+	dirModeFile       = "file"       // execute code blocks in the directory of the markdown file
+)
+
+var settings = Settings{
+	GracePeriod:     5 * time.Second,
+	DirMode:         dirModeInvocation,
+	SecretsProvider: secretProviderEnv,
+	SecretsDir:      ".secrets",
+}
+
 func loadLaunchers() {
 	addedLaunchers := []string{}
 
@@ -52,142 +93,769 @@ func loadLaunchers() {
 	logrus.Debug("Added launchers: ", addedLaunchers)
 }
 
+// metaString returns the value of an attribute set in the infostring of a code fence or in a mdx comment.
+func metaString(meta map[string]any, key string) (string, bool) {
+	value, ok := meta[key].(string)
+	return value, ok
+}
+
+// metaBool returns the value of a boolean attribute. An attribute without a value, like pipe, is true.
+func metaBool(meta map[string]any, key string) (bool, error) {
+	value, ok := metaString(meta, key)
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s=%s: expected true or false", ErrInvalidAttribute, key, value)
+	}
+	return b, nil
+}
+
+// metaDuration returns the value of a duration attribute like timeout=5m.
+func metaDuration(meta map[string]any, key string) (time.Duration, bool, error) {
+	value, ok := metaString(meta, key)
+	if !ok {
+		return 0, false, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %s=%s: %v", ErrInvalidAttribute, key, value, err)
+	}
+	return duration, true, nil
+}
+
+/*
+withTimeout returns a context which is cancelled with a *timeoutError as cause after timeout.
+A timeout of 0 returns ctx unchanged.
+*/
+func withTimeout(ctx context.Context, timeout time.Duration, scope string) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, timeout, &timeoutError{scope: scope, timeout: timeout})
+}
+
+/*
+executeCommandBlock executes commandBlock after its dependencies. Services started by the command or its
+dependencies are stopped before it returns, a service which exited on its own fails the command.
+*/
+func executeCommandBlock(ctx context.Context, commands map[string]CommandBlock, commandBlock *CommandBlock, args ...string) (err error) {
+
+	if _, ok := ctx.Value(runStateKey{}).(*runState); !ok {
+		ctx = withRunState(ctx, newRunState())
+	}
+
+	if err := validateDependencies(commands, commandBlock); err != nil {
+		return err
+	}
+
+	state := getRunState(ctx)
+	state.plan(plannedCommands(commands, commandBlock))
+	defer func() {
+		if stopErr := state.stopServices(context.Cause(ctx)); stopErr != nil {
+			err = errors.Join(err, stopErr)
+		}
+	}()
+	return executeOnce(ctx, commands, commandBlock, args...)
+}
+
+/*
+executeOnce executes commandBlock with its dependencies, unless it was already executed with args in this
+invocation. In this case, the result of the earlier execution is returned.
+*/
+func executeOnce(ctx context.Context, commands map[string]CommandBlock, commandBlock *CommandBlock, args ...string) error {
+	state := getRunState(ctx)
+	if executed, err := state.executedCommand(commandBlock, args); executed {
+		logrus.Debug(fmt.Sprintf("Command '%s' with args %v was already executed", commandBlock.Name, args))
+		return err
+	}
+	err := executeWithDependencies(ctx, commands, commandBlock, args...)
+	state.setExecuted(commandBlock, args, err)
+	return err
+}
+
 /*
-Before executing commandBlock, this function validates that all dependencies are present in the commands map.
+executeWithDependencies executes the dependencies of commandBlock in the order of orderDependencies and then
+commandBlock itself. If it succeeded, the commands listed in its after attribute follow. Finally the on_failure
+and finally handlers of commandBlock are executed. The order_only commands of commandBlock are not executed
+by it, they only order the dependencies.
 */
-func validateDependencies(commands map[string]CommandBlock, commandBlock *CommandBlock) error {
-	for _, dep := range commandBlock.Dependencies {
+func executeWithDependencies(ctx context.Context, commands map[string]CommandBlock, commandBlock *CommandBlock, args ...string) (err error) {
+	state := getRunState(ctx)
+	if err := validateArgs(commandBlock, args); err != nil {
+		return err
+	}
+	// before the dependencies are executed, so a mistyped invocation does not have any effect
+	if err := validateArgUsage(commandBlock, args); err != nil {
+		return err
+	}
+	run, err := evaluateCondition(ctx, commandBlock, &CodeBlock{}, commandBlock.Meta, args...)
+	if err != nil {
+		return err
+	}
+	if !run {
+		condition, _ := metaString(commandBlock.Meta, "if")
+		state.skipCommand(commandBlock, fmt.Sprintf("condition '%s' is false", condition))
+		return nil
+	}
+
+	firstResult := len(state.getResults())
+	defer func() {
+		err = runHandlers(ctx, commands, commandBlock, firstResult, err)
+	}()
+
+	for _, i := range orderDependencies(commands, commandBlock) {
+		dep := commandBlock.Dependencies[i]
 		if _, ok := commands[dep]; !ok {
 			return fmt.Errorf("%w: %s", ErrDependencyNotFound, dep)
 		}
 		dependency := commands[dep]
-		if err := validateDependencies(commands, &dependency); err != nil {
+		depArgs, err := renderDependencyArgs(ctx, commandBlock, i, args)
+		if err != nil {
+			return err
+		}
+		logrus.Debug(fmt.Sprintf("Executing dependency %s of %s with args %v", dependency.Name, commandBlock.Name, depArgs))
+		if err := executeOnce(ctx, commands, &dependency, depArgs...); err != nil {
+			skipped := commandEvent(eventCommandSkipped, commandBlock)
+			skipped.Reason = fmt.Sprintf("dependency '%s' failed", dependency.Name)
+			state.emit(skipped)
+			return err
+		}
+	}
+
+	// order_only commands are never executed for commandBlock, they can only be waited for
+	for _, name := range commandNames(commandBlock, relationOrderOnly) {
+		orderOnly := commands[name]
+		if state.isPlanned(name) && !state.executedAny(&orderOnly) {
+			logrus.Warn(fmt.Sprintf("Command '%s' is executed before '%s', because '%s' is only executed later in this invocation", commandBlock.Name, name, name))
+		}
+	}
+
+	if err := runCommandBlock(ctx, commandBlock, args...); err != nil {
+		return err
+	}
+
+	for _, name := range commandNames(commandBlock, relationAfter) {
+		after := commands[name]
+		if err := executeOnce(ctx, commands, &after); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func executeCommandBlock(commands map[string]CommandBlock, commandBlock *CommandBlock, args ...string) error {
+// runCommandBlock executes the code blocks of commandBlock and records the result in the run state.
+func runCommandBlock(ctx context.Context, commandBlock *CommandBlock, args ...string) (err error) {
+	state := getRunState(ctx)
+	start := time.Now()
+	started := commandEvent(eventCommandStarted, commandBlock)
+	started.Args = args
+	state.emit(started)
+	defer func() {
+		duration := time.Since(start)
+		state.addCommandResult(commandResult{
+			command:  commandBlock,
+			args:     args,
+			start:    start,
+			duration: duration,
+			err:      err,
+		})
+
+		finished := commandEvent(eventCommandFinished, commandBlock)
+		if err != nil {
+			finished = commandEvent(eventCommandFailed, commandBlock)
+			finished.Error = err.Error()
+		}
+		finished.Duration = duration.Seconds()
+		state.emit(finished)
+	}()
 
-	if err := validateDependencies(commands, commandBlock); err != nil {
+	timeout, _, err := metaDuration(commandBlock.Meta, "timeout")
+	if err != nil {
 		return err
 	}
+	ctx, cancel := withTimeout(ctx, timeout, fmt.Sprintf("command '%s'", commandBlock.Name))
+	defer cancel()
 
-	for _, dep := range commandBlock.Dependencies {
-		if _, ok := commands[dep]; !ok {
-			return fmt.Errorf("%w: %s", ErrDependencyNotFound, dep)
-		}
-		dependency := commands[dep]
-		if err := executeCommandBlock(commands, &dependency); err != nil {
-			logrus.Debug(fmt.Sprintf("Executing command %s with args %v", dependency.Name, args))
-			return err
+	pipe, err := metaBool(commandBlock.Meta, "pipe")
+	if err != nil {
+		return err
+	}
+
+	useSession, err := metaBool(commandBlock.Meta, "session")
+	if err != nil {
+		return err
+	}
+	if useSession && pipe {
+		return fmt.Errorf("%w: pipe and session can not be combined", ErrInvalidAttribute)
+	}
+	isService, err := metaBool(commandBlock.Meta, "service")
+	if err != nil {
+		return err
+	}
+	if isService && (pipe || useSession) {
+		return fmt.Errorf("%w: service can not be combined with pipe or session", ErrInvalidAttribute)
+	}
+	var current *session
+	closeSession := func() {
+		if current != nil {
+			current.close()
+			current = nil
 		}
 	}
+	defer closeSession()
 
+	if pipe {
+		return runPipeline(ctx, commandBlock, args...)
+	}
 	for i, codeBlock := range commandBlock.CodeBlocks {
 		logrus.Debug(fmt.Sprintf("Executing Code Block #%d", i))
 
-		if i == 0 {
-			if err := executeCodeBlock(&codeBlock, args...); err != nil {
-				return err
+		run, err := evaluateCondition(ctx, commandBlock, &codeBlock, codeBlock.Meta, args...)
+		if err != nil {
+			return err
+		}
+		if !run {
+			condition, _ := metaString(codeBlock.Meta, "if")
+			state.skipBlock(commandBlock, &codeBlock, fmt.Sprintf("condition '%s' is false", condition))
+			continue
+		}
+
+		if useSession && supportsSession(&codeBlock) {
+			// consecutive code blocks of the same language share a session
+			if current != nil && current.lang != codeBlock.Lang {
+				closeSession()
+			}
+			if current == nil {
+				if current, err = startSession(ctx, commandBlock, &codeBlock); err != nil {
+					return err
+				}
 			}
-		} else {
-			if err := executeCodeBlock(&codeBlock); err != nil {
+			if err := executeSessionBlock(ctx, current, commandBlock, &codeBlock, args...); err != nil {
 				return err
 			}
+			continue
+		}
+		closeSession()
+
+		if isService && i == len(commandBlock.CodeBlocks)-1 {
+			// the code blocks before the last one prepare the service
+			return startService(ctx, commandBlock, &codeBlock, args...)
+		}
+
+		if err := executeCodeBlock(ctx, commandBlock, &codeBlock, args...); err != nil {
+			return err
 		}
 	}
 
 	return nil
-
 }
-func executeCodeBlock(codeBlock *CodeBlock, args ...string) error {
 
-	// Create a map for the template arguments
-	argMap := make(map[string]string)
-	for i, arg := range args {
-		argMap[fmt.Sprintf("arg%d", i+1)] = arg
+/*
+runPipeline executes the code blocks of commandBlock concurrently, the stdout of a code block is connected to the
+stdin of the next one by a pipe. Code blocks whose condition is false are left out of the pipeline. Only the first
+code block reads from the stdin of mdx and only the last one writes to the stdout of mdx.
+
+The pipeline fails with the error of the first failing code block. A code block which failed because the next
+code block stopped reading its output, like yes in yes | head, does not fail the pipeline. If a code block is
+interrupted or its timeout expires, the other code blocks are stopped as well.
+*/
+func runPipeline(ctx context.Context, commandBlock *CommandBlock, args ...string) error {
+	state := getRunState(ctx)
+	var stages []*CodeBlock
+	for i := range commandBlock.CodeBlocks {
+		codeBlock := &commandBlock.CodeBlocks[i]
+		run, err := evaluateCondition(ctx, commandBlock, codeBlock, codeBlock.Meta, args...)
+		if err != nil {
+			return err
+		}
+		if !run {
+			condition, _ := metaString(codeBlock.Meta, "if")
+			state.skipBlock(commandBlock, codeBlock, fmt.Sprintf("condition '%s' is false", condition))
+			continue
+		}
+		stages = append(stages, codeBlock)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	errs := make([]error, len(stages))
+	var wg sync.WaitGroup
+	var input *os.File
+	for i, codeBlock := range stages {
+		logrus.Debug(fmt.Sprintf("Executing Code Block #%d of the pipeline", i))
+		stdio := blockIO{}
+		if input != nil {
+			stdio.stdin = input
+		}
+		var output *os.File
+		if i < len(stages)-1 {
+			reader, writer, err := os.Pipe()
+			if err != nil {
+				cancel(err)
+				if input != nil {
+					input.Close()
+				}
+				wg.Wait()
+				return fmt.Errorf("failed to create pipe: %v", err)
+			}
+			stdio.stdout, output = writer, writer
+			input = reader
+		}
+
+		wg.Add(1)
+		go func(i int, codeBlock *CodeBlock, stdio blockIO, output *os.File) {
+			defer wg.Done()
+			errs[i] = executeCodeBlockWithIO(ctx, commandBlock, codeBlock, stdio, args...)
+			// the next code block reads until EOF, the previous one gets a broken pipe once nobody reads its output
+			if output != nil {
+				output.Close()
+			}
+			if stdin, ok := stdio.stdin.(*os.File); ok {
+				stdin.Close()
+			}
+			var sigErr *signalError
+			if errors.As(errs[i], &sigErr) || (errs[i] != nil && ctx.Err() != nil) {
+				cancel(errs[i])
+			}
+		}(i, codeBlock, stdio, output)
 	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil && (i == len(errs)-1 || !brokenPipe(err)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockIO connects a code block to other code blocks. The zero value uses the standard streams of mdx.
+type blockIO struct {
+	stdin  io.Reader // if not nil, passed to the code block instead of the stdin of mdx
+	stdout io.Writer // if not nil, receives the stdout of the code block instead of the stdout of mdx
+}
+
+// executeCodeBlock executes codeBlock, which belongs to commandBlock, connected to the standard streams of mdx.
+func executeCodeBlock(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, args ...string) error {
+	return executeCodeBlockWithIO(ctx, commandBlock, codeBlock, blockIO{}, args...)
+}
 
-	// Validate that all placeholders in the template are provided in args and vice versa
-	placeholderPattern := regexp.MustCompile(`{{\s*\.arg(\d+)\s*}}`)
-	matches := placeholderPattern.FindAllStringSubmatch(codeBlock.Code, -1)
+/*
+executeCodeBlockWithIO executes codeBlock, which belongs to commandBlock, connected to stdio.
+If the code block fails, it is rendered and executed again according to its retry policy.
+Code blocks connected to other code blocks are not retried, their input can not be read again.
+*/
+func executeCodeBlockWithIO(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, stdio blockIO, args ...string) (err error) {
 
-	placeholderSet := make(map[string]struct{})
-	for _, match := range matches {
-		placeholderSet[match[1]] = struct{}{}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
 	}
 
-	for i := range args {
-		argKey := fmt.Sprintf("%d", i+1)
-		if _, ok := placeholderSet[argKey]; !ok {
-			return fmt.Errorf("%w: argument: %d (\"%s\")", ErrArgProvidedButNotUsed, i+1, args[i])
+	state := getRunState(ctx)
+	start := time.Now()
+	state.emit(blockEvent(eventBlockStarted, commandBlock, codeBlock))
+	var result attemptResult
+	defer func() {
+		recorded := blockResult{
+			command:   commandBlock,
+			codeBlock: codeBlock,
+			start:     start,
+			duration:  time.Since(start),
+			exitCode:  exitCode(err),
+			err:       err,
 		}
+		result.recorded.fill(&recorded)
+		state.addResult(recorded)
+		state.emit(blockFinishedEvent(commandBlock, codeBlock, recorded.duration, err))
+	}()
+
+	policy, err := getRetryPolicy(commandBlock, codeBlock)
+	if err != nil {
+		return err
+	}
+	if policy.retries > 0 && (stdio.stdin != nil || stdio.stdout != nil) {
+		logrus.Warn(fmt.Sprintf("Retries are not supported in pipelines, executing code block '%s' of command '%s' once", codeBlock.Lang, commandBlock.Name))
+		policy.retries = 0
+	}
+
+	capture, _ := metaString(codeBlock.Meta, "capture")
+	if capture != "" && !outputNamePattern.MatchString(capture) {
+		return fmt.Errorf("%w: capture=%s: expected a valid variable name", ErrInvalidAttribute, capture)
 	}
 
-	for placeholder := range placeholderSet {
-		argIndex := fmt.Sprintf("arg%s", placeholder)
-		if _, ok := argMap[argIndex]; !ok {
-			return fmt.Errorf("%w: {{.arg%s}}", ErrArgUsedInTemplateNotProvided, placeholder)
+	var attempts []error
+	delay := policy.delay
+	for attempt := 1; ; attempt++ {
+		if policy.retries > 0 {
+			logrus.Info(fmt.Sprintf("Executing code block '%s' of command '%s', attempt %d/%d", codeBlock.Lang, commandBlock.Name, attempt, policy.retries+1))
+		}
+
+		result, err = runAttempt(ctx, commandBlock, codeBlock, stdio, capture != "", args...)
+		if err == nil {
+			if capture != "" {
+				result.outputs[capture] = strings.TrimSpace(string(result.stdout))
+			}
+			if len(result.outputs) > 0 {
+				logrus.Debug(fmt.Sprintf("Outputs of command '%s': %v", commandBlock.Name, result.outputs))
+				state.setOutputs(commandBlock.Name, result.outputs)
+			}
+			return nil
+		}
+		attempts = append(attempts, err)
+
+		if attempt > policy.retries || ctx.Err() != nil || !policy.shouldRetry(err) {
+			if len(attempts) > 1 {
+				return &retryError{attempts: attempts}
+			}
+			return err
 		}
+
+		logrus.Warn(fmt.Sprintf("Code block '%s' of command '%s' failed in attempt %d/%d: %v. Retrying in %v", codeBlock.Lang, commandBlock.Name, attempt, policy.retries+1, err, delay))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		delay = time.Duration(float64(delay) * policy.backoff)
 	}
+}
+
+// attemptIO holds the connections of a single execution of a code block.
+type attemptIO struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	env    []string // additional environment variables
+}
+
+// attemptResult is the result of a single execution of a code block.
+type attemptResult struct {
+	outputs  map[string]string // the outputs written to $MDX_OUTPUT
+	stdout   []byte            // the stdout, if it was not written to the stdout of mdx
+	recorded *recorder         // the recorded output, if the output is recorded
+}
 
-	tmpl, err := template.New("command").Parse(codeBlock.Code)
+/*
+runAttempt executes codeBlock once, connected to stdio. If captureStdout is true, the stdout of the
+code block is returned, and it is only written to stdio.stdout, not to the stdout of mdx.
+*/
+func runAttempt(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, stdio blockIO, captureStdout bool, args ...string) (attemptResult, error) {
+	var result attemptResult
+
+	outputFile, err := os.CreateTemp("", "mdx-output-*")
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %v", err)
+		return result, fmt.Errorf("failed to create output file: %v", err)
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	state := getRunState(ctx)
+	aio := attemptIO{
+		stdin:  os.Stdin,
+		stdout: state.stdout,
+		stderr: state.stderr,
+		env:    []string{"MDX_OUTPUT=" + outputFile.Name()},
+	}
+	if stdio.stdin != nil {
+		aio.stdin = stdio.stdin
 	}
+	var stdout bytes.Buffer
+	switch {
+	case stdio.stdout != nil && captureStdout:
+		aio.stdout = io.MultiWriter(stdio.stdout, &stdout)
+	case stdio.stdout != nil:
+		aio.stdout = stdio.stdout
+	case captureStdout:
+		aio.stdout = &stdout
+	}
+	if state.recordOutput {
+		result.recorded = &recorder{}
+		aio.stdout, aio.stderr = result.recorded.tee(aio.stdout, aio.stderr)
+	}
+	aio.stdout, aio.stderr = state.teeEvents(commandBlock, codeBlock, aio.stdout, aio.stderr)
+	var flushLog func()
+	aio.stdout, aio.stderr, flushLog = state.teeLog(commandBlock, aio.stdout, aio.stderr)
+	defer flushLog()
 
-	var renderedCode bytes.Buffer
-	err = tmpl.Execute(&renderedCode, argMap)
+	err = runCodeBlock(ctx, commandBlock, codeBlock, aio, args...)
+	result.stdout = stdout.Bytes()
 	if err != nil {
-		return fmt.Errorf("failed to execute template: %v", err)
+		return result, err
+	}
+
+	result.outputs, err = readOutputFile(outputFile.Name())
+	if err != nil {
+		return result, fmt.Errorf("failed to read outputs of command '%s': %w", commandBlock.Name, err)
+	}
+	return result, nil
+}
+
+// invocationDir returns the directory mdx was started in.
+func invocationDir() string {
+	if settings.InvocationDir != "" {
+		return settings.InvocationDir
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+/*
+workingDirectory returns the directory codeBlock is executed in. By default this is settings.WorkDir,
+or the directory of the markdown file if settings.DirMode is dirModeFile. The default can be overridden
+with the dir attribute of the code block or the command. A relative dir is resolved against the directory
+of the markdown file.
+*/
+func workingDirectory(commandBlock *CommandBlock, codeBlock *CodeBlock) (string, error) {
+	dir := settings.WorkDir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return "", err
+		}
+	}
+
+	fileDir := dir
+	if commandBlock.Filename != "" {
+		absFilename, err := filepath.Abs(commandBlock.Filename)
+		if err != nil {
+			return "", err
+		}
+		fileDir = filepath.Dir(absFilename)
+	}
+	if settings.DirMode == dirModeFile {
+		dir = fileDir
+	}
+
+	if value, ok := blockAttribute(commandBlock, codeBlock, "dir"); ok {
+		dir = value
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(fileDir, dir)
+		}
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%w: %s", ErrWorkDirNotFound, dir)
+	}
+	return dir, nil
+}
+
+// traceCodeBlock logs the rendered code and the environment of a code block on trace level, with secrets masked.
+func traceCodeBlock(commandBlock *CommandBlock, codeBlock *CodeBlock, code string, env []string) {
+	if !logrus.IsLevelEnabled(logrus.TraceLevel) {
+		return
+	}
+	logrus.Trace(redactions.redact(fmt.Sprintf("Rendered code block '%s' in line %d of command '%s':\n%s", codeBlock.Lang, codeBlock.Line, commandBlock.Name, code)))
+	logrus.Trace(redactions.redact(fmt.Sprintf("Environment of code block '%s' in line %d of command '%s':\n%s", codeBlock.Lang, codeBlock.Line, commandBlock.Name, strings.Join(env, "\n"))))
+}
+
+/*
+prepareCodeBlock renders codeBlock with args into a temporary script and returns the command executing it,
+connected to aio. The caller has to remove the script once the command exited.
+*/
+func prepareCodeBlock(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, aio attemptIO, args ...string) (cmd *exec.Cmd, script string, err error) {
+	renderedCode, err := renderCodeBlock(ctx, commandBlock, codeBlock, args...)
+	if err != nil {
+		return nil, "", err
 	}
 
 	launcher, ok := launchers[codeBlock.Lang]
 	if !ok {
-		return fmt.Errorf("%w: %s", ErrNoLauncherDefined, codeBlock.Lang)
+		return nil, "", fmt.Errorf("%w: %s", ErrNoLauncherDefined, codeBlock.Lang)
+	}
+
+	dir, err := workingDirectory(commandBlock, codeBlock)
+	if err != nil {
+		return nil, "", err
 	}
 
 	// Write the rendered code to the temporary file
 	tmpFile, err := os.CreateTemp("", fmt.Sprintf("mdx-*.%s", launcher.extension))
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
+		return nil, "", fmt.Errorf("failed to create temporary file: %v", err)
 	}
-	// Set the permissions of the temporary file to 755
-	if err := os.Chmod(tmpFile.Name(), 0755); err != nil {
-		return fmt.Errorf("failed to set permissions on temporary file: %v", err)
+	defer func() {
+		if err != nil {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	// Set the permissions of the temporary file to 700, the rendered code may contain secrets
+	if err := os.Chmod(tmpFile.Name(), 0700); err != nil {
+		return nil, "", fmt.Errorf("failed to set permissions on temporary file: %v", err)
 	}
 
-	defer os.Remove(tmpFile.Name())
-
 	if !codeBlock.Meta["shebang"].(bool) {
 		if _, err := tmpFile.Write([]byte(fmt.Sprintf("#!/usr/bin/env %s\n", launcher.cmd))); err != nil {
-			return fmt.Errorf("failed to write to temporary file: %v", err)
+			return nil, "", fmt.Errorf("failed to write to temporary file: %v", err)
 		}
 
 	}
-	if _, err := tmpFile.Write(renderedCode.Bytes()); err != nil {
-		return fmt.Errorf("failed to write to temporary file: %v", err)
+	if _, err := tmpFile.WriteString(renderedCode); err != nil {
+		return nil, "", fmt.Errorf("failed to write to temporary file: %v", err)
 	}
 	if err := tmpFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file: %v", err)
+		return nil, "", fmt.Errorf("failed to close temporary file: %v", err)
 	}
 
-	cmd := exec.Command(tmpFile.Name())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd = exec.Command(tmpFile.Name())
+	cmd.Stdin = aio.stdin
+	cmd.Stdout = aio.stdout
+	cmd.Stderr = aio.stderr
+	// do not wait forever for the output of background processes started by the code block
+	cmd.WaitDelay = settings.GracePeriod
 
-	cmd.Dir = os.Getenv("PWD")
+	cmd.Dir = dir
+	cmd.Env = codeBlockEnv(ctx, cmd, aio.env...)
 	logrus.Debug(fmt.Sprintf("Executing command in directory: %s", cmd.Dir))
+	traceCodeBlock(commandBlock, codeBlock, renderedCode, cmd.Env)
+	return cmd, tmpFile.Name(), nil
+}
+
+// runCodeBlock renders codeBlock with args and executes it once.
+func runCodeBlock(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, aio attemptIO, args ...string) error {
+
+	timeout, _, err := metaDuration(codeBlock.Meta, "timeout")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, timeout, fmt.Sprintf("code block '%s'", codeBlock.Lang))
+	defer cancel()
+
+	cmd, script, err := prepareCodeBlock(ctx, commandBlock, codeBlock, aio, args...)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(script)
 
-	if err := cmd.Run(); err != nil {
-		content, readErr := os.ReadFile(tmpFile.Name())
+	if err := runProcess(ctx, cmd); err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrInterrupted) || brokenPipe(err) {
+			return err
+		}
+		content, readErr := os.ReadFile(script)
 		if readErr != nil {
 			return fmt.Errorf("failed to execute command: %v, and failed to read temporary file: %v", err, readErr)
 		}
-		fmt.Printf("Content of tmpFile:\n%s\n", content)
-		return fmt.Errorf("failed to execute command: %v", err)
+		fmt.Fprintf(getRunState(ctx).stderr, "Content of tmpFile:\n%s\n", redactions.redact(string(content)))
+		return fmt.Errorf("%w: %w", ErrExecutionFailed, err)
 	}
 	return nil
 }
+
+/*
+renderCodeBlock validates the arguments used in codeBlock and renders its template with the data of templateData
+and the functions of templateFuncs. Errors refer to the line of the markdown file, see templateError. The code of
+code blocks with template=off is returned unchanged.
+*/
+func renderCodeBlock(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, args ...string) (string, error) {
+	left, right, enabled, err := codeTemplate(commandBlock, codeBlock)
+	if err != nil {
+		return "", err
+	}
+	if !enabled {
+		return codeBlock.Code, nil
+	}
+
+	// Validate that all arguments used in the template are provided. The command validates that every
+	// argument is used by one of its code blocks.
+	fields, err := templateFields(codeBlock.Code, left, right)
+	if err != nil {
+		return "", templateError(commandBlock, codeBlock, err)
+	}
+	for field := range fields {
+		if index, ok := argumentIndex(field); ok && index > len(args) {
+			return "", fmt.Errorf("%w: {{.%s}}", ErrArgUsedInTemplateNotProvided, field)
+		}
+	}
+
+	dir, err := workingDirectory(commandBlock, codeBlock)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New("command").Delims(left, right).Funcs(templateFuncs(ctx, dir)).Option("missingkey=error").Parse(codeBlock.Code)
+	if err != nil {
+		return "", templateError(commandBlock, codeBlock, err)
+	}
+
+	var renderedCode bytes.Buffer
+	err = tmpl.Execute(&renderedCode, templateData(ctx, commandBlock, args, fields))
+	if err != nil {
+		return "", templateError(commandBlock, codeBlock, err)
+	}
+
+	return renderedCode.String(), nil
+}
+
+// codeBlockEnv returns the environment of a code block executed by cmd, including the outputs of previous code blocks.
+func codeBlockEnv(ctx context.Context, cmd *exec.Cmd, extra ...string) []string {
+	env := append(cmd.Environ(), getRunState(ctx).outputEnv()...)
+	env = append(env, handlerEnv(ctx)...)
+	env = append(env, extra...)
+	return append(env, "MDX_INVOCATION_DIR="+invocationDir())
+}
+
+/*
+runProcess starts cmd in its own process group and waits for it to exit.
+
+If ctx is cancelled while the process is running, the signal which caused the cancellation
+is forwarded to the whole process group. Processes which are still running after
+settings.GracePeriod are killed. In this case the cancellation cause is returned.
+*/
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	restoreTerminal := setProcessGroup(cmd)
+	defer restoreTerminal()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+		if sig, ok := interruptSignal(waitErr); ok {
+			return &signalError{sig: sig}
+		}
+		return waitErr
+	case <-ctx.Done():
+	}
+
+	cause := context.Cause(ctx)
+	stopProcess(cmd, exited, cause)
+	return cause
+}
+
+/*
+stopProcess stops the process group of cmd. If cause is a *signalError, its signal is forwarded,
+otherwise stopSignal is sent. Processes which are still running after settings.GracePeriod are killed.
+stopProcess returns as soon as exited is closed.
+*/
+func stopProcess(cmd *exec.Cmd, exited <-chan struct{}, cause error) {
+	sig := stopSignal
+	var sigErr *signalError
+	if errors.As(cause, &sigErr) {
+		sig = sigErr.sig
+	}
+
+	logrus.Debug(fmt.Sprintf("Forwarding signal '%v' to process group %d", sig, cmd.Process.Pid))
+	if err := signalProcessGroup(cmd, sig); err != nil {
+		logrus.Debug(fmt.Sprintf("Failed to signal process group %d: %v", cmd.Process.Pid, err))
+	}
+
+	timer := time.NewTimer(settings.GracePeriod)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		logrus.Warn(fmt.Sprintf("Process group %d did not exit within %v, killing it", cmd.Process.Pid, settings.GracePeriod))
+		if err := signalProcessGroup(cmd, os.Kill); err != nil {
+			logrus.Debug(fmt.Sprintf("Failed to kill process group %d: %v", cmd.Process.Pid, err))
+		}
+		<-exited
+	}
+}
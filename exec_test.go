@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func captureOutput(f func() error) (string, error) {
@@ -52,7 +56,7 @@ func TestExecuteExecuteCommandBlock_ValidCodeBlockExecution(t *testing.T) {
 
 	commandBlock := commands["test"]
 	output, err := captureOutput(func() error {
-		return executeCommandBlock(commands, &commandBlock, args...)
+		return executeCommandBlock(context.Background(), commands, &commandBlock, args...)
 	})
 
 	expectedOutput := "Hello, World\nHello"
@@ -111,7 +115,7 @@ func TestExecuteExecuteCommandBlock_ValidCodeBlockExecutionTwoLayersDependencies
 
 	commandBlock := commands["test"]
 	output, err := captureOutput(func() error {
-		return executeCommandBlock(commands, &commandBlock, args...)
+		return executeCommandBlock(context.Background(), commands, &commandBlock, args...)
 	})
 
 	expectedOutput := "Hello World!"
@@ -139,7 +143,7 @@ func TestExecuteCodeBlock_ValidCodeBlockExecution(t *testing.T) {
 	var wantErr error = nil
 
 	output, err := captureOutput(func() error {
-		return executeCodeBlock(&codeBlock, args...)
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock, args...)
 	})
 
 	expectedOutput := "Hello, World\n"
@@ -167,7 +171,7 @@ func TestExecuteCodeBlock_ValidCodeBlockExecution_CWD(t *testing.T) {
 	var wantErr error = nil
 
 	output, err := captureOutput(func() error {
-		return executeCodeBlock(&codeBlock, args...)
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock, args...)
 	})
 
 	expectedOutput := "Hello, World\n"
@@ -195,7 +199,7 @@ func TestExecuteCodeBlock_ValidCodeBlockExecution_SheBang(t *testing.T) {
 	var wantErr error = nil
 
 	output, err := captureOutput(func() error {
-		return executeCodeBlock(&codeBlock, args...)
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock, args...)
 	})
 
 	expectedOutput := "Hello, World\n"
@@ -221,7 +225,7 @@ func TestExecuteCodeBlock_MissingArgument(t *testing.T) {
 	args := []string{}
 	wantErr := ErrArgUsedInTemplateNotProvided
 
-	err := executeCodeBlock(&codeBlock, args...)
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock, args...)
 
 	if wantErr != nil {
 		if !errors.Is(err, wantErr) {
@@ -232,16 +236,20 @@ func TestExecuteCodeBlock_MissingArgument(t *testing.T) {
 	}
 }
 
-func TestExecuteCodeBlock_UnusedArgument(t *testing.T) {
-	codeBlock := CodeBlock{
-		Lang: "sh",
-		Code: `echo "Hello, {{.arg1}}"`,
-		Meta: map[string]interface{}{"shebang": false},
+func TestExecuteCommandBlock_UnusedArgument(t *testing.T) {
+	commandBlock := CommandBlock{
+		Name: "greet",
+		CodeBlocks: []CodeBlock{
+			{Lang: "sh", Code: `echo "Hello, {{.arg1}}"`, Meta: map[string]interface{}{"shebang": false}},
+			{Lang: "sh", Code: `echo "Bye, {{.arg1}}"`, Meta: map[string]interface{}{"shebang": false}},
+		},
+		Meta: map[string]interface{}{},
 	}
 	args := []string{"World", "Extra"}
 	wantErr := ErrArgProvidedButNotUsed
 
-	err := executeCodeBlock(&codeBlock, args...)
+	commands := map[string]CommandBlock{"greet": commandBlock}
+	err := executeCommandBlock(context.Background(), commands, &commandBlock, args...)
 
 	if wantErr != nil {
 		if !errors.Is(err, wantErr) {
@@ -252,6 +260,30 @@ func TestExecuteCodeBlock_UnusedArgument(t *testing.T) {
 	}
 }
 
+func TestExecuteCommandBlock_ArgumentsInAllCodeBlocks(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commandBlock := CommandBlock{
+		Name: "greet",
+		CodeBlocks: []CodeBlock{
+			{Lang: "sh", Code: `echo "Hello, {{.arg2}}"`, Meta: map[string]interface{}{"shebang": false}},
+			{Lang: "sh", Code: `echo "Bye, {{ .arg1 | printf "%s!" }}"`, Meta: map[string]interface{}{"shebang": false}},
+			{Lang: "sh", Code: `echo "no arguments"`, Meta: map[string]interface{}{"shebang": false}},
+		},
+		Meta: map[string]interface{}{},
+	}
+	commands := map[string]CommandBlock{"greet": commandBlock}
+
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock, "World", "Moon")
+	})
+	if err != nil {
+		t.Fatalf("executeCommandBlock() error = %v", err)
+	}
+	if want := "Hello, Moon\nBye, World!\nno arguments\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
 func TestExecuteCodeBlock_TemplateParsingError(t *testing.T) {
 	codeBlock := CodeBlock{
 		Lang: "sh",
@@ -259,9 +291,9 @@ func TestExecuteCodeBlock_TemplateParsingError(t *testing.T) {
 		Meta: map[string]interface{}{"shebang": false},
 	}
 	args := []string{"World"}
-	wantErr := ErrArgProvidedButNotUsed
+	wantErr := ErrInvalidTemplate
 
-	err := executeCodeBlock(&codeBlock, args...)
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock, args...)
 
 	if wantErr != nil {
 		if !errors.Is(err, wantErr) {
@@ -281,7 +313,7 @@ func TestExecuteCodeBlock_LauncherNotDefined(t *testing.T) {
 	args := []string{"World"}
 	wantErr := ErrNoLauncherDefined
 
-	err := executeCodeBlock(&codeBlock, args...)
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock, args...)
 
 	if wantErr != nil {
 		if !errors.Is(err, wantErr) {
@@ -301,7 +333,7 @@ func TestExecuteCodeBlock_DependencyMissing(t *testing.T) {
 	loadCommands("tests/test_dependency_missing.md", commands)
 	commandBlock := commands["cmd1"]
 	output, err := captureOutput(func() error {
-		return executeCommandBlock(commands, &commandBlock, args...)
+		return executeCommandBlock(context.Background(), commands, &commandBlock, args...)
 	})
 
 	// This test would output Hello, if the availability of all deps is not validated before execution.
@@ -318,3 +350,375 @@ func TestExecuteCodeBlock_DependencyMissing(t *testing.T) {
 		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
 	}
 }
+
+func TestExecuteCodeBlock_InterruptForwardsSignal(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `sleep 10`,
+		Meta: map[string]interface{}{"shebang": false},
+	}
+	wantErr := ErrInterrupted
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { cancel(&signalError{sig: os.Interrupt}) })
+
+	start := time.Now()
+	err := executeCodeBlock(ctx, &CommandBlock{}, &codeBlock)
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executeCodeBlock() returned after %v, expected the signal to stop the code block", elapsed)
+	}
+}
+
+func TestExecuteCodeBlock_InterruptKillsAfterGracePeriod(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	gracePeriod := settings.GracePeriod
+	settings.GracePeriod = 200 * time.Millisecond
+	defer func() { settings.GracePeriod = gracePeriod }()
+
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: "trap '' INT\nsleep 10",
+		Meta: map[string]interface{}{"shebang": false},
+	}
+	wantErr := ErrInterrupted
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { cancel(&signalError{sig: os.Interrupt}) })
+
+	start := time.Now()
+	err := executeCodeBlock(ctx, &CommandBlock{}, &codeBlock)
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executeCodeBlock() returned after %v, expected the code block to be killed", elapsed)
+	}
+}
+
+func TestExecuteCodeBlock_Timeout(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `sleep 10`,
+		Meta: map[string]interface{}{"shebang": false, "timeout": "200ms"},
+	}
+	wantErr := ErrTimeout
+
+	start := time.Now()
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("executeCodeBlock() returned after %v, expected the timeout to stop the code block", elapsed)
+	}
+}
+
+func TestExecuteCommandBlock_Timeout(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	commands := make(map[string]CommandBlock)
+
+	commands["test"] = CommandBlock{
+		Name: "test",
+		CodeBlocks: []CodeBlock{
+			{
+				Lang: "sh",
+				Code: `sleep 0.2`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+			{
+				Lang: "sh",
+				Code: `sleep 0.2`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+			{
+				Lang: "sh",
+				Code: `echo -n "not reached"`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+		},
+		Dependencies: []string{},
+		Meta:         map[string]interface{}{"timeout": "300ms"},
+	}
+	wantErr := ErrTimeout
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock)
+	})
+
+	expectedOutput := ""
+	if output != expectedOutput {
+		t.Errorf("executeCommandBlock() output = %v, expectedOutput %v", output, expectedOutput)
+	}
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCommandBlock() error = %v, wantErr %v", err, wantErr)
+	}
+}
+
+func TestExecuteCodeBlock_InvalidTimeout(t *testing.T) {
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `echo "Hello"`,
+		Meta: map[string]interface{}{"shebang": false, "timeout": "soon"},
+	}
+	wantErr := ErrInvalidAttribute
+
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
+	}
+}
+
+func TestExecuteCommandBlock_WorkingDirectory(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	commands := map[string]CommandBlock{}
+	if err := loadCommands("tests/workdir/workdir.md", commands); err != nil {
+		t.Fatalf("loadCommands() error = %v", err)
+	}
+	cwd, _ := os.Getwd()
+	fileDir := filepath.Join(cwd, "tests", "workdir")
+
+	tests := []struct {
+		command        string
+		dirMode        string
+		expectedOutput string
+	}{
+		{command: "pwd", dirMode: dirModeInvocation, expectedOutput: cwd + "\n"},
+		{command: "pwd", dirMode: dirModeFile, expectedOutput: fileDir + "\n"},
+		{command: "pwd_sub", dirMode: dirModeInvocation, expectedOutput: filepath.Join(fileDir, "sub") + "\n" + filepath.Dir(fileDir) + "\n"},
+	}
+
+	dirMode := settings.DirMode
+	defer func() { settings.DirMode = dirMode }()
+
+	for _, test := range tests {
+		settings.DirMode = test.dirMode
+		commandBlock := commands[test.command]
+		output, err := captureOutput(func() error {
+			return executeCommandBlock(context.Background(), commands, &commandBlock)
+		})
+		if err != nil {
+			t.Errorf("executeCommandBlock(%s) error = %v", test.command, err)
+		}
+		if output != test.expectedOutput {
+			t.Errorf("executeCommandBlock(%s) with dir mode %s output = %v, expectedOutput %v", test.command, test.dirMode, output, test.expectedOutput)
+		}
+	}
+}
+
+func TestExecuteCodeBlock_InvocationDir(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	invocationDir := settings.InvocationDir
+	settings.InvocationDir = "/invoked/here"
+	defer func() { settings.InvocationDir = invocationDir }()
+
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `echo -n "$MDX_INVOCATION_DIR"`,
+		Meta: map[string]interface{}{"shebang": false},
+	}
+
+	output, err := captureOutput(func() error {
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+	})
+
+	if err != nil {
+		t.Errorf("executeCodeBlock() error = %v", err)
+	}
+	if output != "/invoked/here" {
+		t.Errorf("executeCodeBlock() output = %v, expectedOutput %v", output, "/invoked/here")
+	}
+}
+
+func TestExecuteCodeBlock_WorkingDirectoryNotFound(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `pwd`,
+		Meta: map[string]interface{}{"shebang": false, "dir": "does/not/exist"},
+	}
+	wantErr := ErrWorkDirNotFound
+
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
+	}
+}
+
+func TestExecuteCodeBlock_Stdin(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `tr a-z A-Z`,
+		Meta: map[string]interface{}{"shebang": false},
+	}
+
+	r, w, _ := os.Pipe()
+	w.Write([]byte("hello from stdin"))
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	output, err := captureOutput(func() error {
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+	})
+
+	if err != nil {
+		t.Errorf("executeCodeBlock() error = %v", err)
+	}
+	if output != "HELLO FROM STDIN" {
+		t.Errorf("executeCodeBlock() output = %v, expectedOutput %v", output, "HELLO FROM STDIN")
+	}
+}
+
+func TestExecuteCommandBlock_Pipe(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	commands := make(map[string]CommandBlock)
+
+	commands["test"] = CommandBlock{
+		Name: "test",
+		CodeBlocks: []CodeBlock{
+			{
+				Lang: "sh",
+				Code: `echo "{{.arg1}}"`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+			{
+				Lang: "sh",
+				Code: `tr a-z A-Z`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+			{
+				Lang: "sh",
+				Code: `sed 's/^/> /'`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+		},
+		Dependencies: []string{},
+		Meta:         map[string]interface{}{"pipe": "true"},
+	}
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock, "hello")
+	})
+
+	if err != nil {
+		t.Errorf("executeCommandBlock() error = %v", err)
+	}
+	expectedOutput := "> HELLO\n"
+	if output != expectedOutput {
+		t.Errorf("executeCommandBlock() output = %v, expectedOutput %v", output, expectedOutput)
+	}
+}
+
+func TestExecuteCommandBlock_PipeStreaming(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	tests := []struct {
+		name         string
+		codes        []string
+		wantOutput   string
+		wantExitCode int
+	}{
+		{name: "EndlessProducer", codes: []string{"yes", "head -n 3"}, wantOutput: "y\ny\ny\n"},
+		{name: "Concurrent", codes: []string{"echo ready; while [ ! -f $DONE ]; do sleep 0.01; done", "read line; touch $DONE; echo $line"}, wantOutput: "ready\n"},
+		{name: "FirstFailure", codes: []string{"echo a; exit 3", "cat; exit 4", "cat"}, wantOutput: "a\n", wantExitCode: 3},
+		{name: "ConsumerFailure", codes: []string{"yes", "head -n 1; exit 5"}, wantOutput: "y\n", wantExitCode: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DONE", filepath.Join(t.TempDir(), "done"))
+			commandBlock := CommandBlock{Name: "pipeline", Meta: map[string]any{"pipe": "true", "timeout": "10s"}}
+			for _, code := range tt.codes {
+				commandBlock.CodeBlocks = append(commandBlock.CodeBlocks, CodeBlock{Lang: "sh", Code: code, Meta: map[string]any{"shebang": false}})
+			}
+			commands := map[string]CommandBlock{"pipeline": commandBlock}
+
+			var err error
+			output, _ := captureOutput(func() error {
+				err = executeCommandBlock(context.Background(), commands, &commandBlock)
+				return nil
+			})
+			if got := exitCode(err); got != tt.wantExitCode {
+				t.Errorf("executeCommandBlock() exit code = %d, want %d (error %v)", got, tt.wantExitCode, err)
+			}
+			if (tt.wantExitCode == 0 && output != tt.wantOutput) || !strings.Contains(output, tt.wantOutput) {
+				t.Errorf("executeCommandBlock() output = %q, want %q", output, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandBlock_Outputs(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	commands := make(map[string]CommandBlock)
+
+	commands["test"] = CommandBlock{
+		Name: "test",
+		CodeBlocks: []CodeBlock{
+			{
+				Lang: "sh",
+				Code: `echo -n "{{.outputs.setup.VERSION}} $VERSION {{.outputs.setup.DIR}} $DIR"`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+		},
+		Dependencies: []string{"setup"},
+		Meta:         map[string]interface{}{},
+	}
+	commands["setup"] = CommandBlock{
+		Name: "setup",
+		CodeBlocks: []CodeBlock{
+			{
+				Lang: "sh",
+				Code: `echo "  1.2.3  "`,
+				Meta: map[string]interface{}{"shebang": false, "capture": "VERSION"},
+			},
+			{
+				Lang: "sh",
+				Code: `echo "DIR=/tmp/$VERSION" >> "$MDX_OUTPUT"`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+		},
+		Dependencies: []string{},
+		Meta:         map[string]interface{}{},
+	}
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock)
+	})
+
+	if err != nil {
+		t.Errorf("executeCommandBlock() error = %v", err)
+	}
+	expectedOutput := "1.2.3 1.2.3 /tmp/1.2.3 /tmp/1.2.3"
+	if output != expectedOutput {
+		t.Errorf("executeCommandBlock() output = %v, expectedOutput %v", output, expectedOutput)
+	}
+}
+
+func TestExecuteCodeBlock_MissingOutput(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `echo "{{.outputs.setup.VERSION}}"`,
+		Meta: map[string]interface{}{"shebang": false},
+	}
+
+	err := executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+
+	if err == nil {
+		t.Errorf("executeCodeBlock() error = %v, expected an error for the missing output", err)
+	}
+}
@@ -5,6 +5,5 @@ go 1.23.2
 require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/yuin/goldmark v1.7.7
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
 )
-
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
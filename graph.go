@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// command attributes which relate a command to other commands, besides the dependencies in its heading
+const (
+	relationAfter     = "after"      // commands executed after the command succeeded
+	relationOrderOnly = "order_only" // commands executed before the command, only if they are executed anyway
+)
+
+// commandNames returns the commands listed in the attribute of commandBlock, separated by whitespace.
+func commandNames(commandBlock *CommandBlock, attribute string) []string {
+	value, _ := metaString(commandBlock.Meta, attribute)
+	return strings.Fields(value)
+}
+
+/*
+commandKey identifies the execution of a command with arguments. Every command is executed
+at most once per invocation with the same arguments.
+*/
+func commandKey(commandBlock *CommandBlock, args []string) string {
+	return strings.Join(append([]string{commandBlock.Filename, commandBlock.Name}, args...), "\x00")
+}
+
+/*
+predecessors returns the commands which have to be executed before name, if they are executed:
+its dependencies, its order_only commands and the commands which list name in their after attribute.
+*/
+func predecessors(commands map[string]CommandBlock, name string) []string {
+	command := commands[name]
+	before := append([]string{}, command.Dependencies...)
+	before = append(before, commandNames(&command, relationOrderOnly)...)
+	for other := range commands {
+		otherCommand := commands[other]
+		for _, after := range commandNames(&otherCommand, relationAfter) {
+			if after == name {
+				before = append(before, other)
+			}
+		}
+	}
+	return before
+}
+
+/*
+Before executing commandBlock, this function validates that all dependencies, related commands and handlers
+of commandBlock and of the commands it leads to are present in the commands map, that the dependencies
+receive the arguments they declare, that after and order_only commands do not declare params, and that
+the commands do not have to be executed before themselves.
+*/
+func validateDependencies(commands map[string]CommandBlock, commandBlock *CommandBlock) error {
+	reachable := make(map[string]bool)
+	var visit func(command *CommandBlock) error
+	visit = func(command *CommandBlock) error {
+		if reachable[command.Name] {
+			return nil
+		}
+		reachable[command.Name] = true
+
+		related := []string{}
+		for _, attribute := range []string{relationAfter, relationOrderOnly, handlerOnFailure, handlerFinally} {
+			for _, name := range commandNames(command, attribute) {
+				relatedCommand, ok := commands[name]
+				if !ok {
+					return fmt.Errorf("%w: %s=%s", ErrDependencyNotFound, attribute, name)
+				}
+				if params := commandParams(&relatedCommand); len(params) > 0 && (attribute == relationAfter || attribute == relationOrderOnly) {
+					return fmt.Errorf("%w: %s=%s of command '%s': '%s' declares params=%s, only dependencies receive arguments", ErrInvalidAttribute, attribute, name, command.Name, name, strings.Join(params, " "))
+				}
+				related = append(related, name)
+			}
+		}
+		for i, dep := range command.Dependencies {
+			dependency, ok := commands[dep]
+			if !ok {
+				return fmt.Errorf("%w: %s", ErrDependencyNotFound, dep)
+			}
+			if i < len(command.DependencyArgs) {
+				if err := validateArgs(&dependency, command.DependencyArgs[i]); err != nil {
+					return fmt.Errorf("dependency '%s' of command '%s': %w", dep, command.Name, err)
+				}
+			}
+			related = append(related, dep)
+		}
+		for _, name := range related {
+			next := commands[name]
+			if err := visit(&next); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(commandBlock); err != nil {
+		return err
+	}
+
+	// depth-first search for a cycle among the reachable commands, following the predecessors
+	const (
+		unvisited = iota
+		visiting
+		finished
+	)
+	state := make(map[string]int)
+	var path []string
+	var findCycle func(name string) error
+	findCycle = func(name string) error {
+		switch state[name] {
+		case finished:
+			return nil
+		case visiting:
+			start := 0
+			for path[start] != name {
+				start++
+			}
+			cycle := append(append([]string{}, path[start:]...), name)
+			return fmt.Errorf("%w: %s", ErrDependencyCycle, strings.Join(cycle, " -> "))
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, before := range predecessors(commands, name) {
+			if !reachable[before] {
+				continue
+			}
+			if err := findCycle(before); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = finished
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(reachable)) {
+		if err := findCycle(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+orderDependencies returns the indices of the dependencies of commandBlock in the order they are executed.
+A dependency is executed before another one, if a command executed for it has to precede a command executed
+for the other one because of an order_only or after relation. Otherwise, and if the relations contradict
+each other, the dependencies keep the order of the heading.
+*/
+func orderDependencies(commands map[string]CommandBlock, commandBlock *CommandBlock) []int {
+	count := len(commandBlock.Dependencies)
+	subtrees := make([]map[string]bool, count)
+	for i, dep := range commandBlock.Dependencies {
+		dependency := commands[dep]
+		subtrees[i] = plannedCommands(commands, &dependency)
+	}
+	// precedes reports whether a command of subtree first has to be executed before a command of subtree second
+	precedes := func(first, second map[string]bool) bool {
+		for name := range second {
+			command := commands[name]
+			for _, orderOnly := range commandNames(&command, relationOrderOnly) {
+				if first[orderOnly] && !second[orderOnly] {
+					return true
+				}
+			}
+		}
+		for name := range first {
+			command := commands[name]
+			for _, after := range commandNames(&command, relationAfter) {
+				if second[after] && !first[after] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	before := make([][]bool, count)
+	for i := range before {
+		before[i] = make([]bool, count)
+	}
+	for i := 0; i < count; i++ {
+		for j := i + 1; j < count; j++ {
+			iFirst, jFirst := precedes(subtrees[i], subtrees[j]), precedes(subtrees[j], subtrees[i])
+			before[i][j] = iFirst && !jFirst
+			before[j][i] = jFirst && !iFirst
+		}
+	}
+
+	// stable topological sort, the first dependency without pending predecessors is executed next
+	order := make([]int, 0, count)
+	done := make([]bool, count)
+	for len(order) < count {
+		next := -1
+		for j := 0; j < count && next < 0; j++ {
+			if done[j] {
+				continue
+			}
+			ready := true
+			for i := 0; i < count; i++ {
+				if !done[i] && before[i][j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = j
+			}
+		}
+		if next < 0 {
+			// contradicting relations, keep the order of the heading
+			for j := 0; j < count; j++ {
+				if !done[j] {
+					next = j
+					break
+				}
+			}
+		}
+		done[next] = true
+		order = append(order, next)
+	}
+	return order
+}
+
+/*
+plannedCommands returns the names of the commands which are executed when commandBlock is executed:
+commandBlock, its dependencies and the commands executed after them, recursively. Handlers are not
+planned, because they are only executed depending on the result of their command.
+*/
+func plannedCommands(commands map[string]CommandBlock, commandBlock *CommandBlock) map[string]bool {
+	planned := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if planned[name] {
+			return
+		}
+		planned[name] = true
+		command := commands[name]
+		for _, dep := range command.Dependencies {
+			visit(dep)
+		}
+		for _, after := range commandNames(&command, relationAfter) {
+			visit(after)
+		}
+	}
+	planned[commandBlock.Name] = true
+	for _, dep := range commandBlock.Dependencies {
+		visit(dep)
+	}
+	for _, after := range commandNames(commandBlock, relationAfter) {
+		visit(after)
+	}
+	return planned
+}
+
+// executedCommand returns the result of the command with args, if it was already executed in this invocation.
+func (s *runState) executedCommand(commandBlock *CommandBlock, args []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err, ok := s.executed[commandKey(commandBlock, args)]
+	return ok, err
+}
+
+// executedAny reports whether the command was already executed in this invocation, with any arguments.
+func (s *runState) executedAny(commandBlock *CommandBlock) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := commandKey(commandBlock, nil)
+	for key := range s.executed {
+		if key == prefix || strings.HasPrefix(key, prefix+"\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+// setExecuted records the result of the command with args.
+func (s *runState) setExecuted(commandBlock *CommandBlock, args []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.executed[commandKey(commandBlock, args)] = err
+}
+
+// plan records the commands which are executed in this invocation.
+func (s *runState) plan(planned map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range planned {
+		s.planned[name] = true
+	}
+}
+
+// isPlanned reports whether the command is executed in this invocation, see plannedCommands.
+func (s *runState) isPlanned(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.planned[name]
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func graphCommand(name string, deps []string, meta map[string]any) CommandBlock {
+	return CommandBlock{
+		Name:         name,
+		Dependencies: deps,
+		CodeBlocks:   []CodeBlock{{Lang: "sh", Code: "echo " + name, Meta: map[string]any{"shebang": false}}},
+		Meta:         meta,
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []CommandBlock
+		wantErr  error
+	}{
+		{
+			name: "Valid",
+			commands: []CommandBlock{
+				graphCommand("a", []string{"b"}, map[string]any{"after": "c", "order_only": "d"}),
+				graphCommand("b", nil, map[string]any{}),
+				graphCommand("c", []string{"b"}, map[string]any{}),
+				graphCommand("d", nil, map[string]any{}),
+			},
+		},
+		{
+			name: "DependencyCycle",
+			commands: []CommandBlock{
+				graphCommand("a", []string{"b"}, map[string]any{}),
+				graphCommand("b", []string{"c"}, map[string]any{}),
+				graphCommand("c", []string{"a"}, map[string]any{}),
+			},
+			wantErr: ErrDependencyCycle,
+		},
+		{
+			name: "AfterCycle",
+			commands: []CommandBlock{
+				graphCommand("a", []string{"b"}, map[string]any{"after": "b"}),
+				graphCommand("b", nil, map[string]any{}),
+			},
+			wantErr: ErrDependencyCycle,
+		},
+		{
+			name: "OrderOnlyCycle",
+			commands: []CommandBlock{
+				graphCommand("a", []string{"b"}, map[string]any{}),
+				graphCommand("b", nil, map[string]any{"order_only": "a"}),
+			},
+			wantErr: ErrDependencyCycle,
+		},
+		{
+			name: "AfterWithParams",
+			commands: []CommandBlock{
+				graphCommand("a", nil, map[string]any{"after": "b"}),
+				graphCommand("b", nil, map[string]any{"params": "target"}),
+			},
+			wantErr: ErrInvalidAttribute,
+		},
+		{
+			name: "OrderOnlyWithParams",
+			commands: []CommandBlock{
+				graphCommand("a", []string{"b", "c"}, map[string]any{}),
+				graphCommand("b", nil, map[string]any{"params": "target"}),
+				graphCommand("c", nil, map[string]any{"order_only": "b"}),
+			},
+			wantErr: ErrInvalidAttribute,
+		},
+		{
+			name: "AfterNotFound",
+			commands: []CommandBlock{
+				graphCommand("a", nil, map[string]any{"after": "missing"}),
+			},
+			wantErr: ErrDependencyNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := make(map[string]CommandBlock)
+			for _, command := range tt.commands {
+				commands[command.Name] = command
+			}
+			command := commands["a"]
+			if err := validateDependencies(commands, &command); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateDependencies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandBlock_Order(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"release": graphCommand("release", []string{"build", "test", "migrate"}, map[string]any{"after": "notify"}),
+		"build":   graphCommand("build", nil, map[string]any{"order_only": "migrate"}),
+		"test":    graphCommand("test", []string{"build"}, map[string]any{}),
+		"migrate": graphCommand("migrate", nil, map[string]any{}),
+		"notify":  graphCommand("notify", nil, map[string]any{}),
+	}
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"release", []string{"migrate", "build", "test", "release", "notify"}},
+		{"test", []string{"build", "test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			command := commands[tt.command]
+			output, err := captureOutput(func() error {
+				return executeCommandBlock(context.Background(), commands, &command)
+			})
+			if err != nil {
+				t.Fatalf("executeCommandBlock() error = %v", err)
+			}
+			if got := strings.Fields(output); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("executed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandBlock_OrderOnlyNotExecuted(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"all":   graphCommand("all", []string{"test", "build"}, map[string]any{}),
+		"build": graphCommand("build", nil, map[string]any{}),
+		"test":  graphCommand("test", nil, map[string]any{"order_only": "build"}),
+		"lint":  graphCommand("lint", []string{"test"}, map[string]any{}),
+	}
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"all", []string{"build", "test", "all"}},
+		{"lint", []string{"test", "lint"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			command := commands[tt.command]
+			output, err := captureOutput(func() error {
+				return executeCommandBlock(context.Background(), commands, &command)
+			})
+			if err != nil {
+				t.Fatalf("executeCommandBlock() error = %v", err)
+			}
+			if got := strings.Fields(output); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("executed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandBlock_AfterSkippedOnFailure(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"release": {
+			Name:       "release",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "exit 1", Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{"after": "notify"},
+		},
+		"notify": graphCommand("notify", nil, map[string]any{}),
+	}
+	command := commands["release"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &command)
+	})
+	if !errors.Is(err, ErrExecutionFailed) {
+		t.Errorf("executeCommandBlock() error = %v, want %v", err, ErrExecutionFailed)
+	}
+	if strings.Contains(output, "notify") {
+		t.Errorf("output = %q, want notify to be skipped", output)
+	}
+}
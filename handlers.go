@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handler attributes of a command, in the order the handlers are executed
+const (
+	handlerOnFailure = "on_failure"
+	handlerFinally   = "finally"
+)
+
+// handlerContext is carried by the context of a handler and of its dependencies.
+type handlerContext struct {
+	env   []string // describes the outcome of the command the handler is executed for
+	chain []string // the handlers being executed, the innermost last
+}
+
+type handlerContextKey struct{}
+
+func getHandlerContext(ctx context.Context) handlerContext {
+	hc, _ := ctx.Value(handlerContextKey{}).(handlerContext)
+	return hc
+}
+
+// handlerEnv returns the environment variables describing the outcome of the command a handler is executed for.
+func handlerEnv(ctx context.Context) []string {
+	return getHandlerContext(ctx).env
+}
+
+/*
+failureEnv describes the outcome of commandBlock for its handlers. firstResult is the number of code block
+results recorded before commandBlock and its dependencies were executed, so the code block which caused
+err can be found among the later results:
+
+	MDX_STATUS          success or failure
+	MDX_FAILED_COMMAND  the command which failed, commandBlock itself or one of its dependencies
+	MDX_FAILED_FILE     the markdown file of the failed code block
+	MDX_FAILED_LINE     the line of the failed code block
+	MDX_EXIT_CODE       the exit code of the failed code block, -1 if it did not exit normally
+	MDX_FAILURE         the error message
+*/
+func failureEnv(state *runState, commandBlock *CommandBlock, firstResult int, err error) []string {
+	if err == nil {
+		return []string{"MDX_STATUS=success"}
+	}
+	env := []string{"MDX_STATUS=failure", "MDX_FAILURE=" + err.Error()}
+
+	results := state.getResults()
+	for i := len(results) - 1; i >= firstResult && i < len(results); i-- {
+		if results[i].err != nil {
+			return append(env,
+				"MDX_FAILED_COMMAND="+results[i].command.Name,
+				"MDX_FAILED_FILE="+results[i].command.Filename,
+				"MDX_FAILED_LINE="+strconv.Itoa(results[i].codeBlock.Line),
+				"MDX_EXIT_CODE="+strconv.Itoa(results[i].exitCode),
+			)
+		}
+	}
+	return append(env, "MDX_FAILED_COMMAND="+commandBlock.Name, "MDX_EXIT_CODE=-1")
+}
+
+/*
+runHandlers executes the on_failure handlers of commandBlock if err is not nil, and then its finally handlers,
+each with its dependencies. err is the result of commandBlock and its dependencies. The returned error
+contains err and the errors of all failed handlers. If mdx was interrupted or timed out, the handlers are
+executed nevertheless, as cleanup is needed most then, but they have to finish within settings.GracePeriod.
+*/
+func runHandlers(ctx context.Context, commands map[string]CommandBlock, commandBlock *CommandBlock, firstResult int, err error) error {
+	var handlers []string
+	if err != nil {
+		handlers = append(handlers, commandNames(commandBlock, handlerOnFailure)...)
+	}
+	handlers = append(handlers, commandNames(commandBlock, handlerFinally)...)
+	if len(handlers) == 0 {
+		return err
+	}
+	if ctx.Err() != nil {
+		logrus.Warn(fmt.Sprintf("Executing the handlers %v of command '%s' after '%v' within the grace period of %v", handlers, commandBlock.Name, context.Cause(ctx), settings.GracePeriod))
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(context.WithoutCancel(ctx), settings.GracePeriod, fmt.Sprintf("handlers of command '%s'", commandBlock.Name))
+		defer cancel()
+	}
+
+	env := failureEnv(getRunState(ctx), commandBlock, firstResult, err)
+	chain := getHandlerContext(ctx).chain
+	errs := []error{err}
+	for _, name := range handlers {
+		if slices.Contains(chain, name) {
+			errs = append(errs, fmt.Errorf("%w: '%s' of command '%s' is already being executed", ErrHandlerFailed, name, commandBlock.Name))
+			continue
+		}
+		handler, ok := commands[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrDependencyNotFound, name))
+			continue
+		}
+		handlerCtx := context.WithValue(ctx, handlerContextKey{}, handlerContext{env: env, chain: append(slices.Clip(chain), name)})
+		logrus.Info(fmt.Sprintf("Executing handler '%s' of command '%s'", name, commandBlock.Name))
+		if handlerErr := executeWithDependencies(handlerCtx, commands, &handler); handlerErr != nil {
+			errs = append(errs, fmt.Errorf("%w: '%s' of command '%s': %w", ErrHandlerFailed, name, commandBlock.Name, handlerErr))
+		}
+	}
+	return errors.Join(errs...)
+}
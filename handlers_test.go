@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func handlerCommands(deployCode string, deployMeta map[string]any) map[string]CommandBlock {
+	return map[string]CommandBlock{
+		"setup": {
+			Name:       "setup",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "echo setup", Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{},
+		},
+		"deploy": {
+			Name:         "deploy",
+			Filename:     "runbook.md",
+			Dependencies: []string{"setup"},
+			CodeBlocks:   []CodeBlock{{Lang: "sh", Code: deployCode, Line: 7, Meta: map[string]any{"shebang": false}}},
+			Meta:         deployMeta,
+		},
+		"rollback": {
+			Name:       "rollback",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: `echo "rollback $MDX_FAILED_COMMAND $MDX_FAILED_FILE:$MDX_FAILED_LINE $MDX_EXIT_CODE"`, Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{},
+		},
+		"cleanup": {
+			Name:       "cleanup",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: `echo "cleanup $MDX_STATUS"`, Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{},
+		},
+		"broken": {
+			Name:       "broken",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "exit 2", Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{"finally": "broken"},
+		},
+	}
+}
+
+func TestExecuteCommandBlock_Handlers(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	tests := []struct {
+		name       string
+		code       string
+		meta       map[string]any
+		wantOutput string
+		wantErr    []error
+	}{
+		{
+			name:       "Success",
+			code:       "echo deployed",
+			meta:       map[string]any{"on_failure": "rollback", "finally": "cleanup"},
+			wantOutput: "setup\ndeployed\ncleanup success\n",
+		},
+		{
+			name:       "Failure",
+			code:       "exit 3",
+			meta:       map[string]any{"on_failure": "rollback", "finally": "cleanup"},
+			wantOutput: "setup\nrollback deploy runbook.md:7 3\ncleanup failure\n",
+			wantErr:    []error{ErrExecutionFailed},
+		},
+		{
+			name:       "FailingHandler",
+			code:       "exit 3",
+			meta:       map[string]any{"finally": "broken cleanup"},
+			wantOutput: "setup\ncleanup failure\n",
+			wantErr:    []error{ErrExecutionFailed, ErrHandlerFailed},
+		},
+		{
+			name:    "UnknownHandler",
+			code:    "echo deployed",
+			meta:    map[string]any{"finally": "missing"},
+			wantErr: []error{ErrDependencyNotFound},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := handlerCommands(tt.code, tt.meta)
+			command := commands["deploy"]
+			output, err := captureOutput(func() error {
+				state := newRunState()
+				state.stderr = io.Discard
+				return executeCommandBlock(withRunState(context.Background(), state), commands, &command)
+			})
+			for _, wantErr := range tt.wantErr {
+				if !errors.Is(err, wantErr) {
+					t.Errorf("executeCommandBlock() error = %v, want %v", err, wantErr)
+				}
+			}
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Errorf("executeCommandBlock() error = %v", err)
+			}
+			if tt.wantOutput != "" && output != tt.wantOutput {
+				t.Errorf("output = %q, want %q", output, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandBlock_RecursiveHandler(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := handlerCommands("true", map[string]any{})
+	command := commands["broken"]
+	_, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &command)
+	})
+	if !errors.Is(err, ErrHandlerFailed) || !strings.Contains(err.Error(), "already being executed") {
+		t.Errorf("executeCommandBlock() error = %v, want the recursion to be rejected", err)
+	}
+}
+
+func TestExecuteCommandBlock_HandlersAfterTimeout(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := handlerCommands("sleep 10", map[string]any{"on_failure": "rollback", "finally": "cleanup"})
+	command := commands["deploy"]
+	ctx, cancel := withTimeout(context.Background(), 200*time.Millisecond, "mdx")
+	defer cancel()
+
+	output, err := captureOutput(func() error {
+		state := newRunState()
+		state.stderr = io.Discard
+		return executeCommandBlock(withRunState(ctx, state), commands, &command)
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("executeCommandBlock() error = %v, want %v", err, ErrTimeout)
+	}
+	if !strings.Contains(output, "rollback deploy runbook.md:7") || !strings.HasSuffix(output, "cleanup failure\n") {
+		t.Errorf("output = %q, want the handlers to be executed after the timeout", output)
+	}
+}
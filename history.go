@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxHistoryOutput is the maximum size of the output recorded in the history, longer output is truncated at the start.
+const maxHistoryOutput = 64 * 1024
+
+// maxHistorySize is the size of the history file after which it is rotated to path.1, replacing the previous one.
+var maxHistorySize int64 = 10 * 1024 * 1024
+
+// historyEntry is an invocation of mdx recorded in the history.
+type historyEntry struct {
+	ID         int       `json:"id"`
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args"`
+	File       string    `json:"file"`               // absolute path of the markdown file defining the command
+	Hash       string    `json:"hash"`               // sha256 of the markdown file when the command was executed
+	Dir        string    `json:"dir"`                // the directory mdx was started in
+	Argv       []string  `json:"argv"`               // the arguments of mdx, used to rerun the invocation
+	Redacted   bool      `json:"redacted,omitempty"` // secrets were masked in Argv, so it can not be rerun
+	ExitStatus int       `json:"exit_status"`
+	Duration   float64   `json:"duration_seconds"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"` // stdout and stderr of the code blocks, if recorded with --history-output
+}
+
+/*
+historyPath returns the path of the history file, $XDG_STATE_HOME/mdx/history.jsonl.
+If XDG_STATE_HOME is not set, ~/.local/state is used as specified by the XDG base directory specification.
+*/
+func historyPath() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "mdx", "history.jsonl"), nil
+}
+
+// historyEnabled reports whether invocations are recorded, which can be disabled with MDX_HISTORY=off.
+func historyEnabled() bool {
+	return os.Getenv("MDX_HISTORY") != "off"
+}
+
+/*
+readHistory returns the entries of the history file at path and of its rotated file path.1, oldest first.
+A missing file is an empty history.
+*/
+func readHistory(path string) ([]historyEntry, error) {
+	entries, err := readHistoryFile(path + ".1")
+	if err != nil {
+		return nil, err
+	}
+	current, err := readHistoryFile(path)
+	return append(entries, current...), err
+}
+
+// readHistoryFile returns the entries of the history file at path, oldest first. A missing file has no entries.
+func readHistoryFile(path string) ([]historyEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(file)
+	// JSON escapes control characters in the output with up to 6 bytes
+	scanner.Buffer(make([]byte, 0, 64*1024), 8*maxHistoryOutput)
+	for line := 1; scanner.Scan(); line++ {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logrus.Warn(fmt.Sprintf("Ignoring invalid entry in line %d of '%s': %v", line, path, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+/*
+appendHistory appends entry to the history file at path. The entry gets the next free ID, which follows the ID
+of the last entry in the file. The file is locked while appending, so concurrent invocations of mdx get
+different IDs. Once the file exceeds maxHistorySize, it is rotated to path.1.
+*/
+func appendHistory(path string, entry *historyEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	file, err := openLockedHistory(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	id, err := lastHistoryID(file)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		// the file was rotated or is new, continue with the IDs of the rotated file
+		if rotated, err := os.Open(path + ".1"); err == nil {
+			id, err = lastHistoryID(rotated)
+			rotated.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	entry.ID = id + 1
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxHistorySize {
+		// other invocations waiting for the lock notice the rename and open the new file
+		return os.Rename(path, path+".1")
+	}
+	return nil
+}
+
+/*
+openLockedHistory opens the history file at path for appending and locks it exclusively.
+The lock is released when the file is closed.
+*/
+func openLockedHistory(path string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		// another invocation may have rotated the file while this one waited for the lock
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(opened, current) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
+
+/*
+lastHistoryID returns the ID of the last entry of the history file, or 0 if it has no entries.
+Only the end of the file is read, backwards until the start of the last line.
+*/
+func lastHistoryID(file *os.File) (int, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	const chunkSize = 64 * 1024
+	var tail []byte
+	for offset := info.Size(); offset > 0; {
+		size := min(int64(chunkSize), offset)
+		offset -= size
+		chunk := make([]byte, size)
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return 0, err
+		}
+		tail = append(chunk, tail...)
+
+		line := bytes.TrimRight(tail, "\n")
+		if len(line) == 0 {
+			continue
+		}
+		if start := bytes.LastIndexByte(line, '\n'); start >= 0 || offset == 0 {
+			var entry historyEntry
+			if err := json.Unmarshal(line[start+1:], &entry); err == nil {
+				return entry.ID, nil
+			}
+			// the last entry is damaged, e.g. by a crash while writing it, so the IDs of all entries are needed
+			logrus.Warn(fmt.Sprintf("Ignoring invalid last entry of '%s'", file.Name()))
+			entries, err := readHistoryFile(file.Name())
+			if err != nil || len(entries) == 0 {
+				return 0, err
+			}
+			return entries[len(entries)-1].ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// fileHash returns the hex encoded sha256 of the file at path, or an empty string if it can not be read.
+func fileHash(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+recordHistory records the invocation of command with args, which returned err, in the history.
+Secrets are masked in the arguments, the error and the output. Failing to record the invocation is logged, it does not fail the command.
+*/
+func recordHistory(command *CommandBlock, args []string, state *runState, start time.Time, err error) {
+	if !historyEnabled() {
+		return
+	}
+	path, pathErr := historyPath()
+	if pathErr != nil {
+		logrus.Warn(fmt.Sprintf("Not recording the invocation in the history: %v", pathErr))
+		return
+	}
+
+	file, _ := filepath.Abs(command.Filename)
+	entry := historyEntry{
+		Time:       start,
+		Command:    command.Name,
+		Args:       redactions.redactAll(args),
+		File:       file,
+		Hash:       fileHash(command.Filename),
+		Dir:        invocationDir(),
+		Argv:       redactions.redactAll(os.Args[1:]),
+		ExitStatus: 0,
+		Duration:   time.Since(start).Seconds(),
+		Error:      redactions.redact(errorString(err)),
+	}
+	if err != nil {
+		entry.ExitStatus = exitStatus(err)
+	}
+	entry.Redacted = !slices.Equal(entry.Argv, os.Args[1:])
+	if settings.HistoryOutput {
+		var output []byte
+		for _, result := range state.getResults() {
+			output = append(output, result.output...)
+		}
+		if len(output) > maxHistoryOutput {
+			output = output[len(output)-maxHistoryOutput:]
+		}
+		entry.Output = redactions.redact(string(output))
+	}
+
+	if err := appendHistory(path, &entry); err != nil {
+		logrus.Warn(fmt.Sprintf("Failed to record the invocation in the history '%s': %v", path, err))
+	}
+}
+
+// historyFilter selects the entries listed by mdx history.
+type historyFilter struct {
+	command string // only entries of this command, if set
+	failed  bool   // only entries with a non-zero exit status
+	limit   int    // only the last limit entries, if greater than 0
+}
+
+// filterHistory returns the entries matching filter, oldest first.
+func filterHistory(entries []historyEntry, filter historyFilter) []historyEntry {
+	var matching []historyEntry
+	for _, entry := range entries {
+		if filter.command != "" && entry.Command != filter.command {
+			continue
+		}
+		if filter.failed && entry.ExitStatus == 0 {
+			continue
+		}
+		matching = append(matching, entry)
+	}
+	if filter.limit > 0 && len(matching) > filter.limit {
+		matching = matching[len(matching)-filter.limit:]
+	}
+	return matching
+}
+
+// printHistory prints entries as a table to w.
+func printHistory(w io.Writer, entries []historyEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tCOMMAND\tSTATUS\tDURATION\tFILE")
+	for _, entry := range entries {
+		command := strings.Join(append([]string{entry.Command}, entry.Args...), " ")
+		duration := time.Duration(entry.Duration * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%v\t%s\n", entry.ID, entry.Time.Local().Format("2006-01-02 15:04:05"), command, entry.ExitStatus, duration, entry.File)
+	}
+	tw.Flush()
+}
+
+// printHistoryEntry prints all details of entry to w, including the recorded output.
+func printHistoryEntry(w io.Writer, entry historyEntry) {
+	fmt.Fprintf(w, "ID:          %d\n", entry.ID)
+	fmt.Fprintf(w, "Time:        %s\n", entry.Time.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Command:     %s\n", strings.Join(append([]string{entry.Command}, entry.Args...), " "))
+	fmt.Fprintf(w, "File:        %s\n", entry.File)
+	fmt.Fprintf(w, "Directory:   %s\n", entry.Dir)
+	fmt.Fprintf(w, "Invocation:  mdx %s\n", strings.Join(entry.Argv, " "))
+	if entry.Redacted {
+		fmt.Fprintf(w, "             secrets are masked, the invocation can not be rerun\n")
+	}
+	fmt.Fprintf(w, "Exit status: %d\n", entry.ExitStatus)
+	fmt.Fprintf(w, "Duration:    %v\n", time.Duration(entry.Duration*float64(time.Second)).Round(time.Millisecond))
+	if entry.Error != "" {
+		fmt.Fprintf(w, "Error:       %s\n", entry.Error)
+	}
+	if entry.Output != "" {
+		fmt.Fprintf(w, "Output:\n%s", withTrailingNewline(entry.Output))
+	}
+}
+
+// findHistoryEntry returns the entry with id, or the last entry if id is 0.
+func findHistoryEntry(entries []historyEntry, id int) (historyEntry, error) {
+	if len(entries) == 0 {
+		return historyEntry{}, fmt.Errorf("%w: the history is empty", ErrHistoryEntryNotFound)
+	}
+	if id == 0 {
+		return entries[len(entries)-1], nil
+	}
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return historyEntry{}, fmt.Errorf("%w: %d", ErrHistoryEntryNotFound, id)
+}
+
+/*
+rerun repeats the invocation recorded in entry: mdx is executed again with the same arguments in the
+same directory. A warning is logged if the markdown file changed since. Invocations whose arguments
+contained secrets are refused, the history only holds the masked arguments.
+*/
+func rerun(entry historyEntry) error {
+	if entry.Redacted {
+		return fmt.Errorf("%w: the arguments of run %d contained secrets, which are masked in the history", ErrRerunNotPossible, entry.ID)
+	}
+	if hash := fileHash(entry.File); hash != entry.Hash {
+		logrus.Warn(fmt.Sprintf("'%s' changed since run %d", entry.File, entry.ID))
+	}
+	if err := os.Chdir(entry.Dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Rerunning: mdx %s\n", strings.Join(entry.Argv, " "))
+	return execSelf(entry.Argv)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHistoryPath(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/state")
+	path, err := historyPath()
+	if err != nil || path != "/state/mdx/history.jsonl" {
+		t.Errorf("historyPath() = %q, %v, want /state/mdx/history.jsonl", path, err)
+	}
+}
+
+func TestAppendHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mdx", "history.jsonl")
+
+	entries, err := readHistory(path)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("readHistory() of missing file = %v, %v, want no entries", entries, err)
+	}
+
+	for _, entry := range []historyEntry{
+		{Command: "build", Args: []string{"linux"}},
+		{Command: "deploy", ExitStatus: 1},
+		{Command: "build", Args: []string{"darwin"}},
+	} {
+		if err := appendHistory(path, &entry); err != nil {
+			t.Fatalf("appendHistory() error = %v", err)
+		}
+	}
+
+	entries, err = readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory() error = %v", err)
+	}
+	if len(entries) != 3 || entries[2].ID != 3 || entries[2].Args[0] != "darwin" {
+		t.Fatalf("readHistory() = %+v, want 3 entries with increasing IDs", entries)
+	}
+
+	if got := filterHistory(entries, historyFilter{command: "build"}); len(got) != 2 {
+		t.Errorf("filterHistory() by command = %+v, want 2 entries", got)
+	}
+	if got := filterHistory(entries, historyFilter{failed: true}); len(got) != 1 || got[0].Command != "deploy" {
+		t.Errorf("filterHistory() failed = %+v, want deploy", got)
+	}
+	if got := filterHistory(entries, historyFilter{limit: 1}); len(got) != 1 || got[0].ID != 3 {
+		t.Errorf("filterHistory() limit = %+v, want the last entry", got)
+	}
+
+	tests := []struct {
+		id      int
+		wantID  int
+		wantErr error
+	}{
+		{0, 3, nil},
+		{2, 2, nil},
+		{7, 0, ErrHistoryEntryNotFound},
+	}
+	for _, tt := range tests {
+		entry, err := findHistoryEntry(entries, tt.id)
+		if !errors.Is(err, tt.wantErr) || entry.ID != tt.wantID {
+			t.Errorf("findHistoryEntry(%d) = %d, %v, want %d, %v", tt.id, entry.ID, err, tt.wantID, tt.wantErr)
+		}
+	}
+	if _, err := findHistoryEntry(nil, 0); !errors.Is(err, ErrHistoryEntryNotFound) {
+		t.Errorf("findHistoryEntry() of empty history error = %v, want %v", err, ErrHistoryEntryNotFound)
+	}
+}
+
+func TestAppendHistory_LastID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	for _, entry := range []historyEntry{
+		{Command: "build"},
+		{Command: "build", Output: strings.Repeat("\x01", maxHistoryOutput)},
+		{Command: "deploy"},
+	} {
+		if err := appendHistory(path, &entry); err != nil {
+			t.Fatalf("appendHistory() error = %v", err)
+		}
+	}
+	entries, err := readHistory(path)
+	if err != nil || len(entries) != 3 || entries[2].ID != 3 {
+		t.Errorf("readHistory() = %d entries, %v, want 3 entries, the last with ID 3", len(entries), err)
+	}
+}
+
+func TestAppendHistory_Rotate(t *testing.T) {
+	previous := maxHistorySize
+	maxHistorySize = 300
+	t.Cleanup(func() { maxHistorySize = previous })
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	for i := 0; i < 10; i++ {
+		if err := appendHistory(path, &historyEntry{Command: "build"}); err != nil {
+			t.Fatalf("appendHistory() error = %v", err)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("rotated history: %v", err)
+	}
+	entries, err := readHistory(path)
+	if err != nil || len(entries) == 0 || len(entries) >= 10 || entries[len(entries)-1].ID != 10 {
+		t.Errorf("readHistory() = %+v, %v, want the last entries up to ID 10", entries, err)
+	}
+}
+
+func TestAppendHistory_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := appendHistory(path, &historyEntry{Command: "build"}); err != nil {
+				t.Errorf("appendHistory() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := readHistory(path)
+	if err != nil || len(entries) != 20 {
+		t.Fatalf("readHistory() = %d entries, %v, want 20", len(entries), err)
+	}
+	ids := make(map[int]bool)
+	for _, entry := range entries {
+		ids[entry.ID] = true
+	}
+	if len(ids) != 20 || !ids[1] || !ids[20] {
+		t.Errorf("IDs = %v, want 1 to 20", ids)
+	}
+}
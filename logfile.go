@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// commandPlaceholder in the path of the log file is replaced by the name of the command, to get a log file per command.
+const commandPlaceholder = "{command}"
+
+// rotatingFile is a log file which is rotated once it exceeds maxSize: path is renamed to path.1,
+// path.1 to path.2 and so on. At most maxFiles rotated files are kept.
+type rotatingFile struct {
+	path     string
+	maxSize  int64 // 0 disables the rotation
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxFiles > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+/*
+logFiles writes the log of an invocation: the output of the code blocks and the messages of mdx,
+line by line with a timestamp, the name of the command and the stream. If the path contains
+commandPlaceholder, every command is logged to its own file and the messages of mdx to the file of
+the invoked command. Secrets are masked with redactions.
+*/
+type logFiles struct {
+	mu       sync.Mutex
+	path     string
+	command  string // the invoked command
+	maxSize  int64
+	maxFiles int
+	files    map[string]*rotatingFile
+}
+
+func newLogFiles(path string, command string, maxSize int64, maxFiles int) *logFiles {
+	return &logFiles{path: path, command: command, maxSize: maxSize, maxFiles: maxFiles, files: make(map[string]*rotatingFile)}
+}
+
+// file returns the log file of command, opening it if necessary. l.mu must be held.
+func (l *logFiles) file(command string) (*rotatingFile, error) {
+	path := strings.ReplaceAll(l.path, commandPlaceholder, strings.ReplaceAll(command, string(filepath.Separator), "_"))
+	if f, ok := l.files[path]; ok {
+		return f, nil
+	}
+	f, err := openRotatingFile(path, l.maxSize, l.maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	l.files[path] = f
+	return f, nil
+}
+
+// writeLine writes line to the log file of command, prefixed with the time, label and source.
+func (l *logFiles) writeLine(command string, label string, source string, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := l.file(command)
+	if err != nil {
+		// logging with logrus would call writeLine again
+		fmt.Fprintf(os.Stderr, "Failed to open log file: %v\n", err)
+		return
+	}
+	fmt.Fprintf(f, "%s [%s] %s: %s\n", time.Now().UTC().Format(time.RFC3339Nano), label, source, redactions.redact(line))
+}
+
+func (l *logFiles) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for path, f := range l.files {
+		f.Close()
+		delete(l.files, path)
+	}
+}
+
+// Levels implements logrus.Hook, so the messages of mdx are written to the log file.
+func (l *logFiles) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (l *logFiles) Fire(entry *logrus.Entry) error {
+	for _, line := range strings.Split(strings.TrimSuffix(entry.Message, "\n"), "\n") {
+		l.writeLine(l.command, "mdx", entry.Level.String(), line)
+	}
+	return nil
+}
+
+// logLineWriter writes the output of a code block to the log line by line.
+type logLineWriter struct {
+	mu      sync.Mutex
+	logs    *logFiles
+	command string
+	source  string
+	buf     []byte
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := strings.IndexByte(string(w.buf), '\n')
+		if i < 0 {
+			break
+		}
+		w.logs.writeLine(w.command, w.command, w.source, strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes the last line, if it did not end with a newline.
+func (w *logLineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.logs.writeLine(w.command, w.command, w.source, string(w.buf))
+		w.buf = nil
+	}
+}
+
+/*
+teeLog returns writers which write to stdout and stderr and to the log file of commandBlock.
+The returned function writes incomplete last lines and must be called once the code block finished.
+stdout and stderr are returned unchanged if no log file is written.
+*/
+func (s *runState) teeLog(commandBlock *CommandBlock, stdout io.Writer, stderr io.Writer) (io.Writer, io.Writer, func()) {
+	if s.logs == nil {
+		return stdout, stderr, func() {}
+	}
+	logStdout := &logLineWriter{logs: s.logs, command: commandBlock.Name, source: "stdout"}
+	logStderr := &logLineWriter{logs: s.logs, command: commandBlock.Name, source: "stderr"}
+	return io.MultiWriter(stdout, logStdout), io.MultiWriter(stderr, logStderr), func() {
+		logStdout.flush()
+		logStderr.flush()
+	}
+}
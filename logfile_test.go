@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "mdx.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	f.Close()
+
+	// every line exceeds the size together with the previous one, only 2 rotated files are kept
+	for suffix, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil || string(data) != want {
+			t.Errorf("content of mdx.log%s = %q, %v, want %q", suffix, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("mdx.log.3 exists, want it removed")
+	}
+}
+
+func TestLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	redactions = &redactor{}
+	redactions.addValue("hunter22")
+
+	state := newRunState()
+	state.logs = newLogFiles(filepath.Join(dir, "{command}.log"), "deploy", 0, 0)
+	stdout, stderr, flush := state.teeLog(&CommandBlock{Name: "build"}, &strings.Builder{}, &strings.Builder{})
+	stdout.Write([]byte("compiling\nusing hunter"))
+	stdout.Write([]byte("22"))
+	stderr.Write([]byte("warning\n"))
+	flush()
+	state.logs.Fire(&logrus.Entry{Level: logrus.WarnLevel, Message: "deploying"})
+	state.logs.close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "build.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{"[build] stdout: compiling", "[build] stderr: warning", "[build] stdout: using ***"}
+	if len(lines) != len(want) {
+		t.Fatalf("build.log = %q, want %d lines", lines, len(want))
+	}
+	timestamp := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\S+Z `)
+	for i, line := range lines {
+		if !timestamp.MatchString(line) || !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d of build.log = %q, want timestamp and %q", i+1, line, want[i])
+		}
+	}
+
+	// the messages of mdx are written to the log of the invoked command
+	data, err = os.ReadFile(filepath.Join(dir, "deploy.log"))
+	if err != nil || !strings.HasSuffix(strings.TrimSpace(string(data)), "[mdx] warning: deploying") {
+		t.Errorf("deploy.log = %q, %v, want the message of mdx", data, err)
+	}
+}
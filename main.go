@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -12,6 +21,8 @@ import (
 func setLogLevel() {
 	logLevel := os.Getenv("MDX_LOG_LEVEL")
 	switch logLevel {
+	case "TRACE":
+		logrus.SetLevel(logrus.TraceLevel)
 	case "DEBUG":
 		logrus.SetLevel(logrus.DebugLevel)
 	case "INFO":
@@ -23,69 +34,228 @@ func setLogLevel() {
 	}
 }
 
+/*
+verbosityFlag is a boolean flag which adds its steps to the verbosity when it is set, so -v -v and -vv
+both log debug messages.
+*/
+type verbosityFlag struct {
+	verbosity *int
+	steps     int
+}
+
+func (f verbosityFlag) String() string {
+	return ""
+}
+
+func (f verbosityFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f verbosityFlag) Set(value string) error {
+	set, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if set {
+		*f.verbosity += f.steps
+	}
+	return nil
+}
+
+/*
+setVerbosity overrides the log level set with MDX_LOG_LEVEL: quiet only logs errors, every verbosity step
+logs more details, from info over debug to trace, which includes the rendered code blocks and their environment.
+quiet can not be combined with a verbosity.
+*/
+func setVerbosity(verbosity int, quiet bool) error {
+	switch {
+	case quiet && verbosity > 0:
+		return fmt.Errorf("%w: -q can not be combined with -v, -vv or -vvv", ErrInvalidArguments)
+	case quiet:
+		logrus.SetLevel(logrus.ErrorLevel)
+	case verbosity >= 3:
+		logrus.SetLevel(logrus.TraceLevel)
+	case verbosity == 2:
+		logrus.SetLevel(logrus.DebugLevel)
+	case verbosity == 1:
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	return nil
+}
+
+// log formats
+const (
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+// setLogFormat sets the format of the messages of mdx, which are always written to stderr with secrets masked.
+func setLogFormat(format string) error {
+	logrus.SetOutput(os.Stderr)
+	switch format {
+	case logFormatText:
+		logrus.SetFormatter(redactingFormatter{&logrus.TextFormatter{}})
+	case logFormatJSON:
+		logrus.SetFormatter(redactingFormatter{&logrus.JSONFormatter{}})
+	case logFormatLogfmt:
+		logrus.SetFormatter(redactingFormatter{&logrus.TextFormatter{DisableColors: true, FullTimestamp: true}})
+	default:
+		return fmt.Errorf("unknown log format '%s': expected '%s', '%s' or '%s'", format, logFormatText, logFormatJSON, logFormatLogfmt)
+	}
+	return nil
+}
+
+const usage = `Usage: mdx [-file <markdown-file>] [-list] [run [-write-output]] <command> [args]
+       mdx test [-update] [markdown-files]
+       mdx watch [-watch <glob>] [-debounce <duration>] [-clear=false] <command> [args]
+       mdx history [-n <count>] [-command <command>] [-failed]
+       mdx last
+       mdx rerun [id]`
+
+// envString returns the value of the environment variable name, or def if it is not set.
+func envString(name string, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+// envInt returns the integer value of the environment variable name, or def if it is not set.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		errorExit("Invalid value '%s' of %s: expected a number", value, name)
+	}
+	return i
+}
+
 func errorExit(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	fmt.Fprintln(os.Stderr, redactions.redact(fmt.Sprintf(format, args...)))
 	os.Exit(1)
 }
 
+// exitStatus returns the exit status of mdx for the error returned by a command.
+// Commands stopped by a signal exit with 128 + the signal number, like a shell does.
+// Commands stopped by a timeout exit with 124, like timeout(1) does.
+func exitStatus(err error) int {
+	var sigErr *signalError
+	if errors.As(err, &sigErr) {
+		if sig, ok := sigErr.sig.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+	if errors.Is(err, ErrTimeout) {
+		return 124
+	}
+	return 1
+}
+
+/*
+handleSignals returns a context which is cancelled as soon as mdx receives one of the terminationSignals.
+The cause of the cancellation is a *signalError, which is used to forward the signal to the running code block.
+*/
+func handleSignals() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, terminationSignals...)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			logrus.Debug(fmt.Sprintf("Received signal '%v'", sig))
+			cancel(&signalError{sig: sig})
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 /*
-getMarkdownFilePaths returns a list of markdown files to load commands from.
+getMarkdownFilePaths returns a list of markdown files to load commands from, see findMarkdownFiles.
+mdx exits if no markdown file is found.
+*/
+func getMarkdownFilePaths(fileFlag string) []string {
+	mdFiles, err := findMarkdownFiles(fileFlag)
+	if err != nil {
+		errorExit("%v", err)
+	}
+	if len(mdFiles) == 0 {
+		errorExit("No markdown files found")
+	}
+	return mdFiles
+}
+
+/*
+findMarkdownFiles returns the markdown files to load commands from, which may be none.
 The order of precedence is:
 1. The file flag
 2. The MDX_FILE_DIR environment variable
 3. The MDX_FILE_PATH environment variable
 4. The current working directory
 */
-func getMarkdownFilePaths(fileFlag string) []string {
-	var mdFiles []string
+func findMarkdownFiles(fileFlag string) ([]string, error) {
 	if fileFlag != "" {
 		logrus.Debug("using file flag to find markdown files")
-		mdFiles = []string{fileFlag}
-
-	} else if mdxFileDir := os.Getenv("MDX_FILE_DIR"); mdxFileDir != "" {
+		return []string{fileFlag}, nil
+	}
+	if mdxFileDir := os.Getenv("MDX_FILE_DIR"); mdxFileDir != "" {
 		logrus.Debug("using MDX_FILE_DIR")
-		var err error
-		mdFiles, err = filepath.Glob(filepath.Join(mdxFileDir, "*.md"))
 		logrus.Debug(fmt.Sprintf("Searching for markdown files in %s", mdxFileDir))
+		mdFiles, err := filepath.Glob(filepath.Join(mdxFileDir, "*.md"))
 		if err != nil {
-			errorExit("Error searching for markdown files in %s: %v", mdxFileDir, err)
+			return nil, fmt.Errorf("Error searching for markdown files in %s: %v", mdxFileDir, err)
 		}
-	} else if mdxFilePath := os.Getenv("MDX_FILE_PATH"); mdxFilePath != "" {
+		return mdFiles, nil
+	}
+	if mdxFilePath := os.Getenv("MDX_FILE_PATH"); mdxFilePath != "" {
 		logrus.Debug("using MDX_FILE_PATH")
-		var err error
-		mdFiles = []string{mdxFilePath}
 		logrus.Debug(fmt.Sprintf("Searching in markdown file %s", mdxFilePath))
-		if err != nil {
-			errorExit("Error searching for markdown files in %s: %v", mdxFilePath, err)
-		}
-	} else {
-		logrus.Debug("using CWD to find markdown files")
-		var err error
-		mdFiles, err = filepath.Glob("*.md")
-		if err != nil {
-			errorExit("Error searching for markdown files: %v", err)
-		}
+		return []string{mdxFilePath}, nil
 	}
-
-	if len(mdFiles) == 0 {
-		errorExit("No markdown files found")
+	logrus.Debug("using CWD to find markdown files")
+	mdFiles, err := filepath.Glob("*.md")
+	if err != nil {
+		return nil, fmt.Errorf("Error searching for markdown files: %v", err)
 	}
-	return mdFiles
+	return mdFiles, nil
 }
 
 type CodeBlock struct {
-	Lang string         // the infostring from the code fence
-	Code string         // the content of the code fence
-	Meta map[string]any // contains metadata for the code block
+	Lang   string         // the infostring from the code fence
+	Code   string         // the content of the code fence
+	Meta   map[string]any // contains metadata for the code block
+	Line   int            // the line of the opening code fence in the markdown file
+	Source SourceRange    // the position of the code fence in the markdown file
+	Output *OutputFence   // the output fence directly below the code fence, if present
+}
+
+// SourceRange is a range of bytes in a markdown file.
+type SourceRange struct {
+	Start int
+	End   int
+}
+
+// OutputFence is a code fence with the infostring "output", which contains the output of the code block above.
+type OutputFence struct {
+	Content string            // the content of the output fence
+	Meta    map[string]string // the attributes in the infostring, e.g. exit=0
+	Source  SourceRange       // the position of the output fence in the markdown file
 }
 
 // CommandBlock represents a heading, which contains one to multiple code fences.
 type CommandBlock struct {
-	Name         string         // the name of the command, same as the key in the commands map
-	Dependencies []string       // commands to execute before this command
-	CodeBlocks   []CodeBlock    // the code fences below the heading
-	Filename     string         // the filename of the markdown file
-	Meta         map[string]any // placeholder for the future
+	Name           string         // the name of the command, same as the key in the commands map
+	Dependencies   []string       // commands to execute before this command
+	DependencyArgs [][]string     // arguments for the dependency with the same index, templates rendered with the arguments of this command
+	CodeBlocks     []CodeBlock    // the code fences below the heading
+	Filename       string         // the filename of the markdown file
+	Meta           map[string]any // placeholder for the future
 }
 
 func listCommands(commands map[string]CommandBlock) {
@@ -105,8 +275,84 @@ func main() {
 	fileFlagShort := flag.String("f", "", "Specify a markdown file (shorthand)")
 	listFlag := flag.Bool("list", false, "list commands")
 	listFlagShort := flag.Bool("l", false, "list commands (shorthand)")
+	flag.DurationVar(&settings.GracePeriod, "grace-period", settings.GracePeriod, "time to wait after forwarding a signal before killing the code block")
+	flag.DurationVar(&settings.Timeout, "timeout", 0, "stop the command and its dependencies after this duration (e.g. 10m)")
+	chdirFlag := flag.String("chdir", "", "change to this directory before loading markdown files and executing commands")
+	chdirFlagShort := flag.String("C", "", "change to this directory before loading markdown files and executing commands (shorthand)")
+	dirModeDefault := dirModeInvocation
+	if dirMode := os.Getenv("MDX_DIR_MODE"); dirMode != "" {
+		dirModeDefault = dirMode
+	}
+	flag.Var(&settings.Reports, "report", "write a report of the executed commands, as junit=path or json=path (repeatable)")
+	flag.StringVar(&settings.Events, "events", "", "write execution events as JSON lines: 'jsonl' to stdout instead of the output of code blocks, 'jsonl=path' to a file")
+	flag.BoolVar(&settings.Timings, "timings", false, "print the durations of the executed commands and code blocks and the critical path")
+	flag.StringVar(&settings.Trace, "trace", "", "write the executed commands and code blocks as Chrome trace event JSON to this file")
+	flag.BoolVar(&settings.HistoryOutput, "history-output", false, "record the output of the code blocks in the history")
+	flag.StringVar(&settings.LogFile, "log-file", os.Getenv("MDX_LOG_FILE"), "write the output of the code blocks and the messages of mdx to this file, '{command}' is replaced by the command name")
+	logMaxSize := flag.Int("log-max-size", envInt("MDX_LOG_MAX_SIZE", 10), "rotate the log file once it exceeds this size in MiB, 0 disables the rotation")
+	flag.IntVar(&settings.LogMaxFiles, "log-max-files", envInt("MDX_LOG_MAX_FILES", 5), "number of rotated log files to keep")
+	flag.StringVar(&settings.LogRedact, "log-redact", os.Getenv("MDX_LOG_REDACT"), "regular expression matching secrets to mask in the log file and the messages of mdx")
+	flag.StringVar(&settings.SecretsProvider, "secrets-provider", envString("MDX_SECRETS_PROVIDER", settings.SecretsProvider), "provider of {{secret \"name\"}}: 'env', 'file', 'pass', 'age', 'gpg' or 'exec'")
+	flag.StringVar(&settings.SecretsDir, "secrets-dir", envString("MDX_SECRETS_DIR", settings.SecretsDir), "directory of the secrets of the file provider")
+	flag.StringVar(&settings.SecretsFile, "secrets-file", os.Getenv("MDX_SECRETS_FILE"), "file with NAME=value lines encrypted with age or gpg, for the age and gpg providers")
+	flag.StringVar(&settings.SecretsCommand, "secrets-command", os.Getenv("MDX_SECRETS_COMMAND"), "command printing the secret named by its argument, for the exec provider")
+	verbosity := 0
+	flag.Var(verbosityFlag{&verbosity, 1}, "v", "verbose: log what mdx does, repeat to log more details")
+	flag.Var(verbosityFlag{&verbosity, 2}, "vv", "very verbose: log debug messages")
+	flag.Var(verbosityFlag{&verbosity, 3}, "vvv", "log trace messages, including the rendered code blocks and their environment")
+	quietFlag := flag.Bool("q", false, "quiet: only log errors")
+	logFormatDefault := logFormatText
+	if logFormat := os.Getenv("MDX_LOG_FORMAT"); logFormat != "" {
+		logFormatDefault = logFormat
+	}
+	logFormat := flag.String("log-format", logFormatDefault, "format of the messages of mdx on stderr: 'text', 'json' or 'logfmt'")
+	flag.StringVar(&settings.DirMode, "dir-mode", dirModeDefault, "default working directory of code blocks: 'invocation' or 'file' (directory of the markdown file)")
 	flag.Parse()
 
+	if err := setVerbosity(verbosity, *quietFlag); err != nil {
+		errorExit("Invalid verbosity: %v", err)
+	}
+	if err := setLogFormat(*logFormat); err != nil {
+		errorExit("Invalid log format: %v", err)
+	}
+	redactions.addEnvironment(os.Environ())
+
+	if *chdirFlagShort != "" {
+		chdirFlag = chdirFlagShort
+	}
+
+	if settings.Events != "" {
+		if _, err := parseEventsFlag(settings.Events); err != nil {
+			errorExit("Invalid events flag: %v", err)
+		}
+	}
+
+	settings.LogMaxSize = int64(*logMaxSize) << 20
+	if settings.LogRedact != "" {
+		pattern, err := regexp.Compile(settings.LogRedact)
+		if err != nil {
+			errorExit("Invalid log redact pattern: %v", err)
+		}
+		redactions.addPattern(pattern)
+	}
+
+	if settings.DirMode != dirModeInvocation && settings.DirMode != dirModeFile {
+		errorExit("Invalid dir mode '%s': expected '%s' or '%s'", settings.DirMode, dirModeInvocation, dirModeFile)
+	}
+
+	var err error
+	if settings.InvocationDir, err = os.Getwd(); err != nil {
+		errorExit("Error determining the current directory: %v", err)
+	}
+	if *chdirFlag != "" {
+		if err := os.Chdir(*chdirFlag); err != nil {
+			errorExit("Error changing directory: %v", err)
+		}
+	}
+	if settings.WorkDir, err = os.Getwd(); err != nil {
+		errorExit("Error determining the current directory: %v", err)
+	}
+
 	if *fileFlagShort != "" {
 		fileFlag = fileFlagShort
 	}
@@ -118,14 +364,62 @@ func main() {
 	logrus.Debug("MDX started with parameters:", os.Args)
 
 	// Check for subcommands
-	if flag.NArg() < 1 && !*listFlag {
-		errorExit("Usage: mdx [-file <markdown-file>] [-list] <command> [args]")
+	args := flag.Args()
+	writeOutput := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "test":
+			testFlags := flag.NewFlagSet("test", flag.ExitOnError)
+			updateFlag := testFlags.Bool("update", false, "replace expected outputs which do not match with the actual output")
+			testFlags.Parse(args[1:])
+			testFiles := testFlags.Args()
+			if len(testFiles) == 0 {
+				testFiles = getMarkdownFilePaths(*fileFlag)
+			}
+			warnShadowedCommand(testFiles, "test")
+			os.Exit(testCommands(testFiles, *updateFlag))
+		case "watch":
+			watchFlags := flag.NewFlagSet("watch", flag.ExitOnError)
+			var options watchOptions
+			watchFlags.Var((*globsFlag)(&options.globs), "watch", "also rerun the command when files matching this glob change, '**' matches any number of directories (repeatable)")
+			watchFlags.DurationVar(&options.debounce, "debounce", 200*time.Millisecond, "time to wait for further changes before rerunning the command")
+			watchFlags.BoolVar(&options.clear, "clear", true, "clear the screen before every run")
+			watchFlags.Parse(args[1:])
+			if watchFlags.NArg() < 1 {
+				errorExit(usage)
+			}
+			mdFiles := getMarkdownFilePaths(*fileFlag)
+			warnShadowedCommand(mdFiles, "watch")
+			loadLaunchers()
+			ctx, cancel := handleSignals()
+			err := watchCommand(ctx, mdFiles, watchFlags.Arg(0), watchFlags.Args()[1:], options)
+			cancel(nil)
+			fmt.Fprintf(os.Stderr, "Stopped watching: %v\n", err)
+			os.Exit(exitStatus(err))
+		case "history", "last", "rerun":
+			// the history does not need markdown files, mdx may be started anywhere
+			if mdFiles, err := findMarkdownFiles(*fileFlag); err == nil {
+				warnShadowedCommand(mdFiles, args[0])
+			}
+			os.Exit(historyCommand(args[0], args[1:]))
+		case "run":
+			runFlags := flag.NewFlagSet("run", flag.ExitOnError)
+			writeOutputFlag := runFlags.Bool("write-output", false, "write the output of every code block into the markdown file below the code block")
+			runFlags.Parse(args[1:])
+			args = runFlags.Args()
+			writeOutput = *writeOutputFlag
+		}
 	}
 
-	commandName := flag.Arg(0)
+	if len(args) < 1 && !*listFlag {
+		errorExit(usage)
+	}
+
+	commandName := ""
 	commandArgs := []string{}
-	if flag.NArg() > 1 {
-		commandArgs = flag.Args()[1:]
+	if len(args) > 0 {
+		commandName = args[0]
+		commandArgs = args[1:]
 	}
 
 	loadLaunchers()
@@ -147,11 +441,207 @@ func main() {
 	}
 
 	if command, ok := commands[commandName]; ok {
-		err := executeCommandBlock(commands, &command, commandArgs...)
+		err := runCommand(commands, &command, commandArgs, writeOutput)
 		if err != nil {
-			errorExit("Error executing command: %v", err)
+			printCommandError(os.Stderr, err)
+			os.Exit(exitStatus(err))
 		}
 	} else {
 		errorExit("Command not found: %s", commandName)
 	}
 }
+
+// warnShadowedCommand warns if one of mdFiles defines a command named like the subcommand, which mdx executes instead.
+func warnShadowedCommand(mdFiles []string, subcommand string) {
+	if file := shadowedCommand(mdFiles, subcommand); file != "" {
+		logrus.Warn(fmt.Sprintf("'mdx %s' executes the subcommand, not the command '%s' of %s. Use 'mdx run %s' to execute the command", subcommand, subcommand, file, subcommand))
+	}
+}
+
+/*
+shadowedCommand returns the markdown file which defines a command named like the subcommand, or an empty string.
+Files which can not be loaded are ignored, the subcommand reports them if it needs them.
+*/
+func shadowedCommand(mdFiles []string, subcommand string) string {
+	for _, mdFile := range mdFiles {
+		commands := map[string]CommandBlock{}
+		if err := loadCommands(mdFile, commands); err != nil {
+			continue
+		}
+		if _, ok := commands[subcommand]; ok {
+			return mdFile
+		}
+	}
+	return ""
+}
+
+// printCommandError prints the error returned by a command to w, with secrets masked.
+func printCommandError(w io.Writer, err error) {
+	fmt.Fprintln(w, redactions.redact(fmt.Sprintf("Error executing command: %v", err)))
+}
+
+/*
+runCommand executes the command with its dependencies until it finishes, times out or mdx receives a signal.
+With writeOutput, the output of every executed code block is written into its markdown file afterwards,
+also when the command failed. The same holds for the reports, timings and trace requested with flags.
+*/
+func runCommand(commands map[string]CommandBlock, command *CommandBlock, args []string, writeOutput bool) (err error) {
+	ctx, cancel := handleSignals()
+	defer cancel(nil)
+	timeoutCtx, cancelTimeout := withTimeout(ctx, settings.Timeout, "mdx")
+	defer cancelTimeout()
+
+	state := newRunState()
+	state.recordOutput = writeOutput || len(settings.Reports) > 0 || settings.HistoryOutput
+	if settings.Events != "" {
+		closeEvents, err := openEvents(state, settings.Events)
+		if err != nil {
+			return err
+		}
+		defer closeEvents()
+	}
+	if settings.LogFile != "" {
+		closeLog := openLog(state, command)
+		defer func() { closeLog(err) }()
+	}
+	start := time.Now()
+	err = executeCommandBlock(withRunState(timeoutCtx, state), commands, command, args...)
+
+	if writeOutput {
+		if _, writeErr := writeOutputs(state.getResults(), notebookAttributes); writeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to write outputs: %w", writeErr))
+		}
+	}
+	if len(settings.Reports) > 0 {
+		if reportErr := writeReports(settings.Reports, newRunReport(state, start, err)); reportErr != nil {
+			err = errors.Join(err, reportErr)
+		}
+	}
+	if settings.Timings {
+		printTimings(os.Stderr, commands, command, state, time.Since(start))
+	}
+	if settings.Trace != "" {
+		if traceErr := writeTrace(settings.Trace, state, start); traceErr != nil {
+			err = errors.Join(err, traceErr)
+		}
+	}
+	recordHistory(command, args, state, start, err)
+	return err
+}
+
+/*
+openEvents sets the event handler of state according to the events flag. If the events are written
+to stdout, the stdout of the code blocks is only contained in the OutputChunk events.
+*/
+func openEvents(state *runState, eventsFlag string) (func(), error) {
+	path, err := parseEventsFlag(eventsFlag)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		state.events = newJSONLEvents(os.Stdout)
+		state.stdout = io.Discard
+		return func() {}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create events file: %w", err)
+	}
+	state.events = newJSONLEvents(file)
+	return func() { file.Close() }, nil
+}
+
+/*
+openLog starts writing the log file of the invocation of command. The returned function logs the result of the invocation and closes the log.
+*/
+func openLog(state *runState, command *CommandBlock) func(err error) {
+	logs := newLogFiles(settings.LogFile, command.Name, settings.LogMaxSize, settings.LogMaxFiles)
+	logs.writeLine(command.Name, "mdx", "info", "started: mdx "+strings.Join(os.Args[1:], " "))
+	state.logs = logs
+	logrus.AddHook(logs)
+
+	return func(err error) {
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+		if err != nil {
+			logs.writeLine(command.Name, "mdx", "error", fmt.Sprintf("failed with exit status %d: %v", exitStatus(err), err))
+		} else {
+			logs.writeLine(command.Name, "mdx", "info", "finished")
+		}
+		logs.close()
+	}
+}
+
+// testCommands tests the commands with expected outputs in files and returns the exit status of mdx.
+func testCommands(files []string, update bool) int {
+	loadLaunchers()
+
+	commands := map[string]CommandBlock{}
+	for _, file := range files {
+		logrus.Debug(fmt.Sprintf("Loading file %s", file))
+		if err := loadCommands(file, commands); err != nil {
+			errorExit("Error loading commands from %s: %v", file, err)
+		}
+	}
+
+	ctx, cancel := handleSignals()
+	defer cancel(nil)
+	timeoutCtx, cancelTimeout := withTimeout(ctx, settings.Timeout, "mdx")
+	defer cancelTimeout()
+
+	if err := runTests(timeoutCtx, os.Stdout, commands, update); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitStatus(err)
+	}
+	return 0
+}
+
+/*
+historyCommand executes the history subcommands and returns the exit status of mdx:
+history lists past invocations, last shows the details of the last invocation and
+rerun repeats an invocation, by default the last one.
+*/
+func historyCommand(subcommand string, args []string) int {
+	flags := flag.NewFlagSet(subcommand, flag.ExitOnError)
+	var filter historyFilter
+	if subcommand == "history" {
+		flags.IntVar(&filter.limit, "n", 20, "number of invocations to list, 0 lists all")
+		flags.StringVar(&filter.command, "command", "", "only list invocations of this command")
+		flags.BoolVar(&filter.failed, "failed", false, "only list failed invocations")
+	}
+	flags.Parse(args)
+
+	path, err := historyPath()
+	if err != nil {
+		errorExit("Error locating the history: %v", err)
+	}
+	entries, err := readHistory(path)
+	if err != nil {
+		errorExit("Error reading the history: %v", err)
+	}
+
+	switch subcommand {
+	case "history":
+		printHistory(os.Stdout, filterHistory(entries, filter))
+	case "last":
+		entry, err := findHistoryEntry(entries, 0)
+		if err != nil {
+			errorExit("Error: %v", err)
+		}
+		printHistoryEntry(os.Stdout, entry)
+	case "rerun":
+		id := 0
+		if flags.NArg() > 0 {
+			if id, err = strconv.Atoi(flags.Arg(0)); err != nil {
+				errorExit("Invalid history id '%s'", flags.Arg(0))
+			}
+		}
+		entry, err := findHistoryEntry(entries, id)
+		if err != nil {
+			errorExit("Error: %v", err)
+		}
+		if err := rerun(entry); err != nil {
+			errorExit("Error rerunning invocation %d: %v", entry.ID, err)
+		}
+	}
+	return 0
+}
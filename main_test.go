@@ -1,10 +1,16 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"syscall"
 	"testing"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestGetMarkdownFilePaths_FileFlag(t *testing.T) {
@@ -79,3 +85,136 @@ func TestGetMarkdownFilePaths_AllDefined(t *testing.T) {
 	}
 
 }
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{err: &signalError{sig: syscall.SIGINT}, expected: 130},
+		{err: fmt.Errorf("failed: %w", &signalError{sig: syscall.SIGTERM}), expected: 143},
+		{err: ErrDependencyNotFound, expected: 1},
+	}
+
+	for _, test := range tests {
+		if status := exitStatus(test.err); status != test.expected {
+			t.Errorf("exitStatus(%v) = %d; want %d", test.err, status, test.expected)
+		}
+	}
+}
+
+func TestSetVerbosity(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	tests := []struct {
+		verbosity int
+		quiet     bool
+		expected  logrus.Level
+		wantErr   error
+	}{
+		{verbosity: 1, expected: logrus.InfoLevel},
+		{verbosity: 2, expected: logrus.DebugLevel},
+		{verbosity: 3, expected: logrus.TraceLevel},
+		{verbosity: 5, expected: logrus.TraceLevel},
+		{quiet: true, expected: logrus.ErrorLevel},
+		{verbosity: 3, quiet: true, expected: logrus.ErrorLevel, wantErr: ErrInvalidArguments},
+	}
+
+	for _, test := range tests {
+		if err := setVerbosity(test.verbosity, test.quiet); !errors.Is(err, test.wantErr) {
+			t.Errorf("setVerbosity(%d, %v) error = %v; want %v", test.verbosity, test.quiet, err, test.wantErr)
+		}
+		if test.wantErr != nil {
+			continue
+		}
+		if level := logrus.GetLevel(); level != test.expected {
+			t.Errorf("setVerbosity(%d, %v) sets level %v; want %v", test.verbosity, test.quiet, level, test.expected)
+		}
+	}
+}
+
+func TestVerbosityFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-v"}, 1},
+		{[]string{"-v", "-v"}, 2},
+		{[]string{"-vv"}, 2},
+		{[]string{"-v", "-vv"}, 3},
+		{[]string{"-vvv", "-v=false"}, 3},
+	}
+
+	for _, test := range tests {
+		verbosity := 0
+		flags := flag.NewFlagSet("mdx", flag.ContinueOnError)
+		flags.Var(verbosityFlag{&verbosity, 1}, "v", "")
+		flags.Var(verbosityFlag{&verbosity, 2}, "vv", "")
+		flags.Var(verbosityFlag{&verbosity, 3}, "vvv", "")
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatalf("Parse(%q) error = %v", test.args, err)
+		}
+		if verbosity != test.want {
+			t.Errorf("Parse(%q) sets verbosity %d; want %d", test.args, verbosity, test.want)
+		}
+	}
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+
+	for _, format := range []string{"text", "json", "logfmt"} {
+		if err := setLogFormat(format); err != nil {
+			t.Errorf("setLogFormat(%q) error = %v", format, err)
+		}
+	}
+	formatter, ok := logrus.StandardLogger().Formatter.(redactingFormatter)
+	if !ok {
+		t.Fatalf("setLogFormat(\"logfmt\") sets formatter %T; want redactingFormatter", logrus.StandardLogger().Formatter)
+	}
+	if _, ok := formatter.Formatter.(*logrus.TextFormatter); !ok {
+		t.Errorf("setLogFormat(\"logfmt\") sets formatter %T; want *logrus.TextFormatter", formatter.Formatter)
+	}
+	if err := setLogFormat("xml"); err == nil {
+		t.Errorf("setLogFormat(\"xml\") error = nil; want an error")
+	}
+}
+
+func TestShadowedCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "runbook.md")
+	content := "# Runbook\n\n## [test]()\n\n```sh\ngo test ./...\n```\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(t.TempDir(), "missing.md"), file}
+
+	tests := []struct {
+		subcommand string
+		want       string
+	}{
+		{"test", file},
+		{"history", ""},
+	}
+	for _, tt := range tests {
+		if got := shadowedCommand(files, tt.subcommand); got != tt.want {
+			t.Errorf("shadowedCommand(%q) = %q, want %q", tt.subcommand, got, tt.want)
+		}
+	}
+}
+
+func TestFindMarkdownFiles_None(t *testing.T) {
+	t.Setenv("MDX_FILE_DIR", "")
+	t.Setenv("MDX_FILE_PATH", "")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if files, err := findMarkdownFiles(""); err != nil || len(files) != 0 {
+		t.Errorf("findMarkdownFiles() = %v, %v, want no files", files, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sourceEdit replaces the bytes between start and end of a markdown file with text.
+type sourceEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+/*
+formatOutputFence returns an output fence containing output. The fence is longer than
+any backtick sequence in the output, so the output can contain code fences itself.
+*/
+func formatOutputFence(output []byte, attributes map[string]string) string {
+	fence := "```"
+	for bytes.Contains(output, []byte(fence)) {
+		fence += "`"
+	}
+
+	var b strings.Builder
+	b.WriteString(fence + outputInfostring)
+	if formatted := formatAttributes(attributes); formatted != "" {
+		b.WriteString(" " + formatted)
+	}
+	b.WriteString("\n")
+	b.Write(output)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		b.WriteString("\n")
+	}
+	b.WriteString(fence + "\n")
+	return b.String()
+}
+
+// applyEdits applies non-overlapping edits to source.
+func applyEdits(source []byte, edits []sourceEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, edit := range edits {
+		source = append(source[:edit.start:edit.start], append([]byte(edit.text), source[edit.end:]...)...)
+	}
+	return source
+}
+
+// outputAttributes sets the attributes of the output fence written for result.
+// attributes initially contains the attributes of the existing output fence, if there is one.
+type outputAttributes func(result blockResult, attributes map[string]string)
+
+// notebookAttributes records the exit status of the code block and the time it was started.
+func notebookAttributes(result blockResult, attributes map[string]string) {
+	attributes["exit"] = strconv.Itoa(result.exitCode)
+	attributes["time"] = result.start.UTC().Format(time.RFC3339)
+}
+
+/*
+writeOutputs writes the output of the executed code blocks into their markdown files. An output fence is
+inserted directly below every code block, or an existing output fence is replaced. The output fence contains
+stdout and stderr of the code block and the attributes set by setAttributes. Other attributes of an
+existing output fence are kept and the rest of the file is preserved byte-for-byte. Secrets are masked in the
+output. All outputs of a file are
+written at once, because every edit moves the code blocks below it. writeOutputs returns the results whose
+output was written, code blocks which moved since they were parsed are skipped.
+*/
+func writeOutputs(results []blockResult, setAttributes outputAttributes) ([]blockResult, error) {
+	resultsByFile := make(map[string][]blockResult)
+	var files []string
+	for _, result := range results {
+		filename := result.command.Filename
+		if filename == "" {
+			continue
+		}
+		if _, ok := resultsByFile[filename]; !ok {
+			files = append(files, filename)
+		}
+		resultsByFile[filename] = append(resultsByFile[filename], result)
+	}
+
+	var written []blockResult
+	for _, filename := range files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return written, err
+		}
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			return written, err
+		}
+
+		// parse the file again, the code blocks might have changed it
+		commands := map[string]CommandBlock{}
+		if err := loadCommands(filename, commands); err != nil {
+			return written, fmt.Errorf("failed to write outputs to '%s': %w", filename, err)
+		}
+		codeBlocks := make(map[int]CodeBlock)
+		for _, command := range commands {
+			for _, codeBlock := range command.CodeBlocks {
+				codeBlocks[codeBlock.Source.Start] = codeBlock
+			}
+		}
+
+		// a code block executed more than once gets the output of the last execution
+		editsByBlock := make(map[int]sourceEdit)
+		var writtenToFile []blockResult
+		for _, result := range resultsByFile[filename] {
+			codeBlock, ok := codeBlocks[result.codeBlock.Source.Start]
+			if !ok || codeBlock.Line != result.codeBlock.Line {
+				logrus.Warn(fmt.Sprintf("Code block of command '%s' in line %d of '%s' has moved, not writing its output", result.command.Name, result.codeBlock.Line, filename))
+				continue
+			}
+
+			attributes := make(map[string]string)
+			if codeBlock.Output != nil {
+				for key, value := range codeBlock.Output.Meta {
+					attributes[key] = value
+				}
+			}
+			setAttributes(result, attributes)
+			// the files are committed, so secrets must not end up in them
+			fence := formatOutputFence([]byte(redactions.redact(string(result.output))), attributes)
+			writtenToFile = append(writtenToFile, result)
+
+			if codeBlock.Output != nil {
+				editsByBlock[codeBlock.Source.Start] = sourceEdit{start: codeBlock.Output.Source.Start, end: codeBlock.Output.Source.End, text: fence}
+				continue
+			}
+			prefix := "\n"
+			if codeBlock.Source.End > 0 && source[codeBlock.Source.End-1] != '\n' {
+				prefix = "\n\n"
+			}
+			editsByBlock[codeBlock.Source.Start] = sourceEdit{start: codeBlock.Source.End, end: codeBlock.Source.End, text: prefix + fence}
+		}
+
+		edits := make([]sourceEdit, 0, len(editsByBlock))
+		for _, edit := range editsByBlock {
+			edits = append(edits, edit)
+		}
+		if err := os.WriteFile(filename, applyEdits(source, edits), info.Mode().Perm()); err != nil {
+			return written, err
+		}
+		written = append(written, writtenToFile...)
+		logrus.Debug(fmt.Sprintf("Wrote outputs of %d code blocks to '%s'", len(edits), filename))
+	}
+
+	return written, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+const notebookSource = "# Notebook\n\n## [greet]()\n\nSay hello.\n\n```sh\necho hello\n```\n\n```sh\necho '```'\nexit 3\n```\n\n```output keep=yes exit=0\nstale\n```\n\nThe end."
+
+func runNotebook(t *testing.T, filename string) {
+	t.Helper()
+	commands := map[string]CommandBlock{}
+	if err := loadCommands(filename, commands); err != nil {
+		t.Fatalf("loadCommands() error = %v", err)
+	}
+
+	var state *runState
+	command := commands["greet"]
+	captureOutput(func() error {
+		state = newRunState()
+		state.recordOutput = true
+		return executeCommandBlock(withRunState(context.Background(), state), commands, &command)
+	})
+	if _, err := writeOutputs(state.getResults(), notebookAttributes); err != nil {
+		t.Fatalf("writeOutputs() error = %v", err)
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	filename := filepath.Join(t.TempDir(), "notebook.md")
+	if err := os.WriteFile(filename, []byte(notebookSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# Notebook\n\n## [greet]()\n\nSay hello.\n\n```sh\necho hello\n```\n\n" +
+		"```output exit=0 time=TIME\nhello\n```\n\n" +
+		"```sh\necho '```'\nexit 3\n```\n\n" +
+		"````output exit=3 keep=yes time=TIME\n```\n````\n\nThe end."
+	timestamps := regexp.MustCompile(`time=\S+`)
+
+	// the second run replaces the output fences written by the first run
+	for i := 0; i < 2; i++ {
+		runNotebook(t, filename)
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := timestamps.ReplaceAllString(string(data), "time=TIME"); got != want {
+			t.Errorf("run %d: writeOutputs() wrote\n%s\nwant\n%s", i+1, got, want)
+		}
+	}
+}
+
+func TestFormatOutputFence(t *testing.T) {
+	tests := []struct {
+		output     string
+		attributes map[string]string
+		want       string
+	}{
+		{"", nil, "```output\n```\n"},
+		{"a", map[string]string{"exit": "0"}, "```output exit=0\na\n```\n"},
+		{"a\n````\n", map[string]string{"note": "two words"}, "`````output note=\"two words\"\na\n````\n`````\n"},
+	}
+
+	for _, tt := range tests {
+		if got := formatOutputFence([]byte(tt.output), tt.attributes); got != tt.want {
+			t.Errorf("formatOutputFence(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
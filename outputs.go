@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// outputs are exported as environment variables, so their names must be valid variable names
+var outputNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/*
+readOutputFile reads the outputs a code block wrote to $MDX_OUTPUT. The format is the same as
+for $GITHUB_OUTPUT in GitHub Actions, one output per line or a multiline value with a delimiter:
+
+	VERSION=1.2.3
+	NOTES<<EOF
+	first line
+	second line
+	EOF
+*/
+func readOutputFile(path string) (map[string]string, error) {
+	outputs := make(map[string]string)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if name, delimiter, ok := strings.Cut(line, "<<"); ok && !strings.Contains(name, "=") {
+			var lines []string
+			terminated := false
+			for scanner.Scan() {
+				if scanner.Text() == delimiter {
+					terminated = true
+					break
+				}
+				lines = append(lines, scanner.Text())
+			}
+			if !terminated {
+				return nil, fmt.Errorf("%w: missing delimiter '%s' for '%s'", ErrInvalidOutput, delimiter, name)
+			}
+			if err := setOutput(outputs, name, strings.Join(lines, "\n")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: expected name=value, got '%s'", ErrInvalidOutput, line)
+		}
+		if err := setOutput(outputs, name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return outputs, scanner.Err()
+}
+
+func setOutput(outputs map[string]string, name string, value string) error {
+	if !outputNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: invalid name '%s'", ErrInvalidOutput, name)
+	}
+	outputs[name] = value
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadOutputFile(t *testing.T) {
+	tests := []struct {
+		content     string
+		expected    map[string]string
+		expectedErr error
+	}{
+		{
+			content:  "",
+			expected: map[string]string{},
+		},
+		{
+			content:  "VERSION=1.2.3\n\nURL=https://example.com/?a=b\n",
+			expected: map[string]string{"VERSION": "1.2.3", "URL": "https://example.com/?a=b"},
+		},
+		{
+			content:  "NOTES<<EOF\nfirst line\nsecond line\nEOF\nEMPTY=\n",
+			expected: map[string]string{"NOTES": "first line\nsecond line", "EMPTY": ""},
+		},
+		{
+			content:     "NOTES<<EOF\nfirst line\n",
+			expectedErr: ErrInvalidOutput,
+		},
+		{
+			content:     "no value\n",
+			expectedErr: ErrInvalidOutput,
+		},
+		{
+			content:     "1VERSION=1.2.3\n",
+			expectedErr: ErrInvalidOutput,
+		},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "output")
+		os.WriteFile(path, []byte(test.content), 0644)
+
+		outputs, err := readOutputFile(path)
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("readOutputFile(%q) error = %v; want %v", test.content, err, test.expectedErr)
+			continue
+		}
+		if test.expectedErr == nil && !reflect.DeepEqual(outputs, test.expected) {
+			t.Errorf("readOutputFile(%q) = %v; want %v", test.content, outputs, test.expected)
+		}
+	}
+}
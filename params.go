@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+/*
+commandParams returns the names of the parameters declared with the params attribute of commandBlock.
+The parameters name the arguments of the command in order, so with params="target stage" the first
+argument is available as {{.target}} in addition to {{.arg1}}.
+*/
+func commandParams(commandBlock *CommandBlock) []string {
+	value, _ := metaString(commandBlock.Meta, "params")
+	return strings.Fields(value)
+}
+
+// validateArgs checks that args match the parameters declared by commandBlock, if it declares any.
+func validateArgs(commandBlock *CommandBlock, args []string) error {
+	params := commandParams(commandBlock)
+	for _, param := range params {
+		if !outputNamePattern.MatchString(param) {
+			return fmt.Errorf("%w: params=%s: '%s' is not a valid parameter name", ErrInvalidAttribute, strings.Join(params, " "), param)
+		}
+		if _, ok := argumentIndex(param); ok || slices.Contains(reservedNames, param) {
+			return fmt.Errorf("%w: params=%s: '%s' is reserved in templates", ErrInvalidAttribute, strings.Join(params, " "), param)
+		}
+	}
+	if len(params) > 0 && len(args) != len(params) {
+		return fmt.Errorf("%w: command '%s' expects %d arguments (%s), got %d", ErrInvalidArguments, commandBlock.Name, len(params), strings.Join(params, " "), len(args))
+	}
+	return nil
+}
+
+// argumentData returns the arguments of commandBlock for templates, as argN and by the names of its parameters.
+func argumentData(commandBlock *CommandBlock, args []string) map[string]any {
+	data := make(map[string]any)
+	params := commandParams(commandBlock)
+	for i, arg := range args {
+		data[fmt.Sprintf("arg%d", i+1)] = arg
+		if i < len(params) {
+			data[params[i]] = arg
+		}
+	}
+	return data
+}
+
+/*
+renderDependencyArgs renders the arguments which commandBlock passes to its dependency with the given index.
+The arguments are templates with the data of templateData and the functions of templateFuncs.
+*/
+func renderDependencyArgs(ctx context.Context, commandBlock *CommandBlock, index int, args []string) ([]string, error) {
+	if index >= len(commandBlock.DependencyArgs) {
+		return nil, nil
+	}
+	dependency := commandBlock.Dependencies[index]
+	dir, err := workingDirectory(commandBlock, &CodeBlock{})
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := make([]string, 0, len(commandBlock.DependencyArgs[index]))
+	for _, arg := range commandBlock.DependencyArgs[index] {
+		fields, err := templateFields(arg, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("%w: argument '%s' of dependency '%s': %v", ErrInvalidArguments, arg, dependency, err)
+		}
+		tmpl, err := template.New(dependency).Funcs(templateFuncs(ctx, dir)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: argument '%s' of dependency '%s': %v", ErrInvalidArguments, arg, dependency, err)
+		}
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, templateData(ctx, commandBlock, args, fields)); err != nil {
+			return nil, fmt.Errorf("%w: argument '%s' of dependency '%s': %v", ErrInvalidArguments, arg, dependency, err)
+		}
+		rendered = append(rendered, value.String())
+	}
+	return rendered, nil
+}
+
+/*
+templateFields returns the names of the fields of the data, which the template code refers to,
+like arg1 for {{.arg1}} or {{ .arg1 | printf "%q" }}. Functions are not checked. left and right
+are the delimiters of the template, "" for the default {{ and }}.
+*/
+func templateFields(code string, left, right string) (map[string]bool, error) {
+	tree := parse.New("code")
+	tree.Mode = parse.SkipFuncCheck
+	if _, err := tree.Parse(code, left, right, map[string]*parse.Tree{}); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]bool)
+	var walk func(node parse.Node)
+	walkBranch := func(branch *parse.BranchNode) {
+		walk(branch.Pipe)
+		walk(branch.List)
+		if branch.ElseList != nil {
+			walk(branch.ElseList)
+		}
+	}
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.FieldNode:
+			fields[n.Ident[0]] = true
+		case *parse.VariableNode:
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				fields[n.Ident[1]] = true
+			}
+		case *parse.IfNode:
+			walkBranch(&n.BranchNode)
+		case *parse.RangeNode:
+			walkBranch(&n.BranchNode)
+		case *parse.WithNode:
+			walkBranch(&n.BranchNode)
+		case *parse.TemplateNode:
+			if n.Pipe != nil {
+				walk(n.Pipe)
+			}
+		}
+	}
+	walk(tree.Root)
+	return fields, nil
+}
+
+// argumentIndex returns N for the field argN, which refers to the N-th argument of a command.
+func argumentIndex(field string) (int, bool) {
+	number, ok := strings.CutPrefix(field, "arg")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.Atoi(number)
+	if err != nil || index < 1 {
+		return 0, false
+	}
+	return index, true
+}
+
+/*
+validateArgUsage checks that every argument of commandBlock is used, as {{.argN}} or by the name of its parameter,
+by at least one of its code blocks, by the arguments it passes to its dependencies or by an if condition of the
+command or its code blocks. A template which refers to .args or .params uses all arguments, e.g. {{index .args 0}}
+or {{range .args}}. Every code block receives all arguments of the command. Code blocks without templates,
+see codeTemplate, do not use arguments.
+*/
+func validateArgUsage(commandBlock *CommandBlock, args []string) error {
+	used := make(map[int]bool)
+	usesAll := false
+	params := commandParams(commandBlock)
+	use := func(fields map[string]bool) {
+		if fields["args"] || fields["params"] {
+			usesAll = true
+		}
+		for field := range fields {
+			if index, ok := argumentIndex(field); ok {
+				used[index] = true
+			}
+		}
+		for i, param := range params {
+			if fields[param] {
+				used[i+1] = true
+			}
+		}
+	}
+
+	conditions := []map[string]any{commandBlock.Meta}
+	for i := range commandBlock.CodeBlocks {
+		conditions = append(conditions, commandBlock.CodeBlocks[i].Meta)
+	}
+	for _, meta := range conditions {
+		condition, ok := metaString(meta, "if")
+		if !ok {
+			continue
+		}
+		fields, err := templateFields(conditionTemplate(condition), "", "")
+		if err != nil {
+			return fmt.Errorf("%w: if=%s: %v", ErrInvalidAttribute, condition, err)
+		}
+		use(fields)
+	}
+
+	for i, dependencyArgs := range commandBlock.DependencyArgs {
+		for _, arg := range dependencyArgs {
+			fields, err := templateFields(arg, "", "")
+			if err != nil {
+				return fmt.Errorf("%w: argument '%s' of dependency '%s': %v", ErrInvalidArguments, arg, commandBlock.Dependencies[i], err)
+			}
+			use(fields)
+		}
+	}
+
+	for i := range commandBlock.CodeBlocks {
+		codeBlock := &commandBlock.CodeBlocks[i]
+		left, right, enabled, err := codeTemplate(commandBlock, codeBlock)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			continue
+		}
+		fields, err := templateFields(codeBlock.Code, left, right)
+		if err != nil {
+			return templateError(commandBlock, codeBlock, err)
+		}
+		use(fields)
+	}
+
+	if usesAll {
+		return nil
+	}
+	for i, arg := range args {
+		if !used[i+1] {
+			return fmt.Errorf("%w: argument: %d (\"%s\")", ErrArgProvidedButNotUsed, i+1, arg)
+		}
+	}
+	return nil
+}
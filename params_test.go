@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		args    []string
+		wantErr error
+	}{
+		{"NoParams", "", []string{"a", "b"}, nil},
+		{"Matching", "target stage", []string{"linux", "prod"}, nil},
+		{"Missing", "target stage", []string{"linux"}, ErrInvalidArguments},
+		{"TooMany", "target", []string{"linux", "prod"}, ErrInvalidArguments},
+		{"InvalidName", "target-os", []string{"linux"}, ErrInvalidAttribute},
+		{"ReservedName", "target environ", []string{"linux", "prod"}, ErrInvalidAttribute},
+		{"EnvName", "target env", []string{"linux", "prod"}, nil},
+		{"ArgumentName", "arg2", []string{"linux"}, ErrInvalidAttribute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := &CommandBlock{Name: "build", Meta: map[string]any{}}
+			if tt.params != "" {
+				command.Meta["params"] = tt.params
+			}
+			if err := validateArgs(command, tt.args); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenderDependencyArgs(t *testing.T) {
+	command := &CommandBlock{
+		Name:           "deploy",
+		Dependencies:   []string{"build", "migrate", "lint"},
+		DependencyArgs: [][]string{{"{{.stage}}", "x-{{.arg1}}"}, {"{{.missing}}"}, nil},
+		Meta:           map[string]any{"params": "stage"},
+	}
+
+	args, err := renderDependencyArgs(context.Background(), command, 0, []string{"prod"})
+	if err != nil || !reflect.DeepEqual(args, []string{"prod", "x-prod"}) {
+		t.Errorf("renderDependencyArgs() = %q, %v; want [prod x-prod]", args, err)
+	}
+	if _, err := renderDependencyArgs(context.Background(), command, 1, []string{"prod"}); !errors.Is(err, ErrInvalidArguments) {
+		t.Errorf("renderDependencyArgs() error = %v, want %v", err, ErrInvalidArguments)
+	}
+	if args, err := renderDependencyArgs(context.Background(), command, 2, []string{"prod"}); err != nil || len(args) != 0 {
+		t.Errorf("renderDependencyArgs() = %q, %v; want no arguments", args, err)
+	}
+}
+
+func TestExecuteCommandBlock_DependencyArgs(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"all": {
+			Name:           "all",
+			Dependencies:   []string{"build", "build", "build"},
+			DependencyArgs: [][]string{{"{{.stage}}"}, {"windows"}, {"{{.stage}}"}},
+			CodeBlocks:     []CodeBlock{{Lang: "sh", Code: "echo all {{.stage}}", Meta: map[string]any{"shebang": false}}},
+			Meta:           map[string]any{"params": "stage"},
+		},
+		"build": {
+			Name:       "build",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "echo build {{.target}}", Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{"params": "target"},
+		},
+	}
+
+	command := commands["all"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &command, "linux")
+	})
+	if err != nil {
+		t.Fatalf("executeCommandBlock() error = %v", err)
+	}
+	want := []string{"build linux", "build windows", "all linux"}
+	if got := strings.Split(strings.TrimSpace(output), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	build := commands["build"]
+	if _, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &build)
+	}); !errors.Is(err, ErrInvalidArguments) {
+		t.Errorf("executeCommandBlock() without arguments error = %v, want %v", err, ErrInvalidArguments)
+	}
+}
+
+func TestExecuteCommandBlock_ArgumentUsage(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	shell := func(code string, meta map[string]any) CodeBlock {
+		meta["shebang"] = false
+		return CodeBlock{Lang: "sh", Code: code, Meta: meta}
+	}
+	commands := map[string]CommandBlock{
+		"build": {
+			Name:       "build",
+			CodeBlocks: []CodeBlock{shell("echo build {{.target}}", map[string]any{})},
+			Meta:       map[string]any{"params": "target"},
+		},
+		"deploy": {
+			Name:           "deploy",
+			Dependencies:   []string{"build"},
+			DependencyArgs: [][]string{{"{{.stage}}"}},
+			CodeBlocks:     []CodeBlock{shell("echo deploy", map[string]any{})},
+			Meta:           map[string]any{"params": "stage"},
+		},
+		"release": {
+			Name:           "release",
+			Dependencies:   []string{"build"},
+			DependencyArgs: [][]string{{"prod"}},
+			CodeBlocks:     []CodeBlock{shell("echo release", map[string]any{})},
+			Meta:           map[string]any{},
+		},
+		"cond": {
+			Name:       "cond",
+			CodeBlocks: []CodeBlock{shell("echo cond", map[string]any{})},
+			Meta:       map[string]any{"if": `eq .arg1 "yes"`},
+		},
+		"block": {
+			Name:       "block",
+			CodeBlocks: []CodeBlock{shell("echo block", map[string]any{"if": `eq .arg1 "yes"`})},
+			Meta:       map[string]any{},
+		},
+	}
+
+	tests := []struct {
+		command string
+		args    []string
+		want    string
+		wantErr error
+	}{
+		{command: "deploy", args: []string{"prod"}, want: "build prod\ndeploy\n"},
+		{command: "cond", args: []string{"yes"}, want: "cond\n"},
+		{command: "block", args: []string{"yes"}, want: "block\n"},
+		{command: "release", args: []string{"prod"}, wantErr: ErrArgProvidedButNotUsed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			command := commands[tt.command]
+			output, err := captureOutput(func() error {
+				return executeCommandBlock(context.Background(), commands, &command, tt.args...)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("executeCommandBlock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// the dependencies are not executed if the arguments are not used
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+const dependencyArgsSource = "# Deploy\n\n## [deploy](build:{{.env}} migrate:prod)\n<!-- mdx params=env -->\n\n```sh\necho deploy {{.env}}\n```\n\n" +
+	"## [build]()\n<!-- mdx params=target -->\n\n```sh\necho build {{.target}}\n```\n\n" +
+	"## [migrate]()\n<!-- mdx params=db -->\n\n```sh\necho migrate {{.db}}\n```\n"
+
+func TestExecuteCommandBlock_DependencyArgsEnv(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	filename := filepath.Join(t.TempDir(), "deploy.md")
+	if err := os.WriteFile(filename, []byte(dependencyArgsSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	commands := map[string]CommandBlock{}
+	if err := loadCommands(filename, commands); err != nil {
+		t.Fatalf("loadCommands() error = %v", err)
+	}
+
+	command := commands["deploy"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &command, "staging")
+	})
+	if err != nil {
+		t.Fatalf("executeCommandBlock() error = %v", err)
+	}
+	if want := "build staging\nmigrate prod\ndeploy staging\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/sirupsen/logrus"
 	"github.com/yuin/goldmark"
@@ -45,7 +50,8 @@ func (p *MdxHeadingParser) Open(parent ast.Node, reader text.Reader, pc parser.C
 		return nil, parser.NoChildren
 	}
 
-	reader.Advance(len(line))
+	// Do not consume the line break, otherwise the parser skips the line below the heading.
+	reader.Advance(len(util.TrimRightSpace(line)))
 	return &MdxHeading{commandName: commandName, deps: deps}, parser.NoChildren
 }
 
@@ -69,6 +75,9 @@ extractCommandAndDepsFromHeading extracts the command name and dependencies from
 The command name is extracted from the link text and the dependencies are extracted from the link destination.
 
 [commandName](dep1 dep2 dep3) => commandName, [dep1, dep2, dep3]
+[commandName](dep1:a,{{.arg1}} dep2) => commandName, [dep1:a,{{.arg1}}, dep2]
+
+Whitespace inside of templates does not separate dependencies.
 */
 
 func extractCommandAndDepsFromHeading(heading string) (string, []string) {
@@ -89,13 +98,252 @@ func extractCommandAndDepsFromHeading(heading string) (string, []string) {
 	if len(matches) > 2 {
 		url = matches[2]
 		depsString := strings.TrimSpace(url)
-		deps := strings.Fields(depsString)
+		deps := splitOutsideTemplates(depsString, unicode.IsSpace)
 		return commandName, deps
 	}
 
 	return commandName, []string{}
 }
 
+/*
+splitOutsideTemplates splits s at every rune for which isSeparator returns true, except inside of {{ }}.
+Empty fields are omitted.
+
+build:{{ .arg1 }} test => [build:{{ .arg1 }}, test]
+*/
+func splitOutsideTemplates(s string, isSeparator func(rune) bool) []string {
+	fields := []string{}
+	var field strings.Builder
+	depth := 0
+	for i, r := range s {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			depth++
+		case strings.HasPrefix(s[i:], "}}") && depth > 0:
+			depth--
+		case depth == 0 && isSeparator(r):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(r)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+/*
+parseDependency parses a dependency in the heading of a command into the name of the dependency
+and the arguments passed to it, which are separated by commas.
+
+build:linux,{{.arg1}} => build, [linux, {{.arg1}}]
+*/
+func parseDependency(dependency string) (string, []string) {
+	name, args, ok := strings.Cut(dependency, ":")
+	if !ok {
+		return dependency, nil
+	}
+	return name, splitOutsideTemplates(args, func(r rune) bool { return r == ',' })
+}
+
+/*
+parseAttributes parses whitespace separated key=value pairs, as found in the infostring of a code fence
+or in a mdx comment below a heading. Values can be quoted with double quotes (Go escape sequences are supported)
+or single quotes (taken literally). A key without a value is set to "true".
+
+timeout=5s retries=3 if='eq os "linux"' pipe => {timeout: 5s, retries: 3, if: eq os "linux", pipe: true}
+*/
+func parseAttributes(input string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	rest := strings.TrimSpace(input)
+
+	for rest != "" {
+		end := strings.IndexFunc(rest, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+		if end == -1 {
+			end = len(rest)
+		}
+		key := rest[:end]
+		if key == "" {
+			return nil, fmt.Errorf("%w: missing key in '%s'", ErrInvalidAttribute, input)
+		}
+		rest = rest[end:]
+
+		if !strings.HasPrefix(rest, "=") {
+			attributes[key] = "true"
+			rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+			continue
+		}
+		rest = rest[1:]
+
+		var value string
+		switch {
+		case strings.HasPrefix(rest, `"`):
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("%w: unterminated value for '%s'", ErrInvalidAttribute, key)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		case strings.HasPrefix(rest, "'"):
+			end := strings.Index(rest[1:], "'")
+			if end == -1 {
+				return nil, fmt.Errorf("%w: unterminated value for '%s'", ErrInvalidAttribute, key)
+			}
+			value = rest[1 : end+1]
+			rest = rest[end+2:]
+		default:
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == -1 {
+				end = len(rest)
+			}
+			value = rest[:end]
+			rest = rest[end:]
+		}
+
+		if rest != "" && !unicode.IsSpace(rune(rest[0])) {
+			return nil, fmt.Errorf("%w: expected whitespace after value of '%s'", ErrInvalidAttribute, key)
+		}
+		attributes[key] = value
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+
+	return attributes, nil
+}
+
+// formatAttributes formats attributes as parsed by parseAttributes, sorted by key.
+func formatAttributes(attributes map[string]string) string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := attributes[key]
+		if value == "" || strings.ContainsAny(value, "\"' \t\n") {
+			value = strconv.Quote(value)
+		}
+		fields = append(fields, key+"="+value)
+	}
+	return strings.Join(fields, " ")
+}
+
+/*
+parseMdxComment returns the attributes of a mdx comment, which configures the command it is placed in:
+
+<!-- mdx timeout=5m retries=3 -->
+
+ok is false if the html block is not a mdx comment.
+*/
+func parseMdxComment(block *ast.HTMLBlock, source []byte) (attributes map[string]string, ok bool, err error) {
+	var content strings.Builder
+	lines := block.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		content.Write(segment.Value(source))
+	}
+	if block.HasClosure() {
+		content.Write(block.ClosureLine.Value(source))
+	}
+
+	comment := strings.TrimSpace(content.String())
+	if !strings.HasPrefix(comment, "<!--") || !strings.HasSuffix(comment, "-->") {
+		return nil, false, nil
+	}
+	comment = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(comment, "<!--"), "-->"))
+	fields := strings.Fields(comment)
+	if len(fields) == 0 || fields[0] != "mdx" {
+		return nil, false, nil
+	}
+
+	attributes, err = parseAttributes(strings.TrimPrefix(comment, "mdx"))
+	return attributes, true, err
+}
+
+// the attributes which a mdx comment before the first command sets for all commands of the file
+var fileAttributeKeys = []string{"template", "delims"}
+
+/*
+fileAttributes returns the attributes of the mdx comments before the first command of the markdown file,
+which are the defaults of all commands in the file, e.g. <!-- mdx delims="[[ ]]" -->. The mdx comment of a
+command and the infostring of a code block override them.
+*/
+func fileAttributes(doc ast.Node, source []byte) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if _, ok := n.(*MdxHeading); ok {
+			break
+		}
+		htmlBlock, ok := n.(*ast.HTMLBlock)
+		if !ok {
+			continue
+		}
+		comment, isMdxComment, err := parseMdxComment(htmlBlock, source)
+		if err != nil {
+			return nil, err
+		}
+		if !isMdxComment {
+			continue
+		}
+		for key, value := range comment {
+			if !slices.Contains(fileAttributeKeys, key) {
+				logrus.Warn(fmt.Sprintf("Ignoring attribute '%s' of the mdx comment before the first command, only %s can be set for a file.", key, strings.Join(fileAttributeKeys, " and ")))
+				continue
+			}
+			attributes[key] = value
+		}
+	}
+	return attributes, nil
+}
+
+// the infostring of a code fence which contains the output of the code block above
+const outputInfostring = "output"
+
+// lineStart returns the offset of the beginning of the line containing offset.
+func lineStart(source []byte, offset int) int {
+	return bytes.LastIndexByte(source[:offset], '\n') + 1
+}
+
+// lineEnd returns the offset after the line break of the line containing offset.
+func lineEnd(source []byte, offset int) int {
+	if i := bytes.IndexByte(source[offset:], '\n'); i >= 0 {
+		return offset + i + 1
+	}
+	return len(source)
+}
+
+/*
+fenceRange returns the byte range of a fenced code block in source, from the beginning of the opening
+fence line to the end of the closing fence line. goldmark only records the infostring and the content,
+so the fence lines are searched around them.
+*/
+func fenceRange(block *ast.FencedCodeBlock, source []byte) SourceRange {
+	lines := block.Lines()
+	var start int
+	switch {
+	case block.Info != nil:
+		start = lineStart(source, block.Info.Segment.Start)
+	case lines.Len() > 0:
+		start = lineStart(source, lineStart(source, lines.At(0).Start)-1)
+	default:
+		return SourceRange{}
+	}
+
+	end := lineEnd(source, start)
+	if lines.Len() > 0 {
+		end = lineEnd(source, lines.At(lines.Len()-1).Start)
+	}
+	if closing := bytes.TrimLeft(source[end:lineEnd(source, end)], " "); bytes.HasPrefix(closing, []byte("```")) || bytes.HasPrefix(closing, []byte("~~~")) {
+		end = lineEnd(source, end)
+	}
+	return SourceRange{Start: start, End: end}
+}
+
 func loadCommands(markdownFile string, commands map[string]CommandBlock) error {
 	/*
 		The search strategy is as follows. We start at the beginning of the document, parse the Markdown file into an AST and walk the tree:
@@ -123,7 +371,14 @@ func loadCommands(markdownFile string, commands map[string]CommandBlock) error {
 	reader := text.NewReader(source)
 	doc := md.Parser().Parse(reader)
 
+	fileMeta, err := fileAttributes(doc, source)
+	if err != nil {
+		return fmt.Errorf("'%s': %w", markdownFile, err)
+	}
+
 	var currentCommandBlock CommandBlock
+	// the node of the last code block appended to currentCommandBlock
+	var lastCodeBlockNode ast.Node
 
 	praseCodeBlock := func(n ast.Node) error {
 
@@ -132,6 +387,29 @@ func loadCommands(markdownFile string, commands map[string]CommandBlock) error {
 			lang := string(block.Language(source))
 			code := string(block.Text(source))
 
+			var attributes map[string]string
+			if block.Info != nil {
+				info := string(block.Info.Segment.Value(source))
+				var err error
+				attributes, err = parseAttributes(strings.TrimPrefix(strings.TrimSpace(info), lang))
+				if err != nil {
+					return fmt.Errorf("code block of command '%s' in '%s': %w", currentCommandBlock.Name, markdownFile, err)
+				}
+			}
+
+			if lang == outputInfostring {
+				if lastCodeBlockNode == nil || n.PreviousSibling() != lastCodeBlockNode {
+					logrus.Debug(fmt.Sprintf("Ignoring output fence of command '%s' in '%s', which does not follow a code block.", currentCommandBlock.Name, markdownFile))
+					return nil
+				}
+				currentCommandBlock.CodeBlocks[len(currentCommandBlock.CodeBlocks)-1].Output = &OutputFence{
+					Content: code,
+					Meta:    attributes,
+					Source:  fenceRange(block, source),
+				}
+				return nil
+			}
+
 			if code == "" {
 				logrus.Warn(fmt.Sprintf("Empty code block found for command '%s' in '%s'.", currentCommandBlock.Name, markdownFile))
 				return nil
@@ -151,13 +429,19 @@ func loadCommands(markdownFile string, commands map[string]CommandBlock) error {
 			}
 
 			codeBlock := CodeBlock{
-				Lang: lang,
-				Code: code,
-				Meta: make(map[string]any),
+				Lang:   lang,
+				Code:   code,
+				Meta:   make(map[string]any),
+				Source: fenceRange(block, source),
+			}
+			codeBlock.Line = bytes.Count(source[:codeBlock.Source.Start], []byte("\n")) + 1
+			for key, value := range attributes {
+				codeBlock.Meta[key] = value
 			}
 			codeBlock.Meta["shebang"] = code_shebang
 
 			currentCommandBlock.CodeBlocks = append(currentCommandBlock.CodeBlocks, codeBlock)
+			lastCodeBlockNode = n
 			logrus.Debug(fmt.Sprintf("Wrote new code block. Infostring: '%s', Command: '%s'", lang, currentCommandBlock.Name))
 		}
 
@@ -169,9 +453,17 @@ func loadCommands(markdownFile string, commands map[string]CommandBlock) error {
 			currentCommandBlock = CommandBlock{}
 			currentCommandBlock.Filename = markdownFile
 			currentCommandBlock.Meta = make(map[string]any)
+			for key, value := range fileMeta {
+				currentCommandBlock.Meta[key] = value
+			}
 			currentCommandBlock.CodeBlocks = []CodeBlock{}
 			currentCommandBlock.Name = heading.commandName
-			currentCommandBlock.Dependencies = heading.deps
+			currentCommandBlock.Dependencies = []string{}
+			for _, dep := range heading.deps {
+				name, args := parseDependency(dep)
+				currentCommandBlock.Dependencies = append(currentCommandBlock.Dependencies, name)
+				currentCommandBlock.DependencyArgs = append(currentCommandBlock.DependencyArgs, args)
+			}
 
 			if _, exists := commands[currentCommandBlock.Name]; exists {
 				return ast.WalkStop, fmt.Errorf("%w: '%s' was already defined in '%s'", ErrDuplicateCommand, currentCommandBlock.Name, commands[currentCommandBlock.Name].Filename)
@@ -191,6 +483,17 @@ func loadCommands(markdownFile string, commands map[string]CommandBlock) error {
 				if _, ok := sibling.(*ast.FencedCodeBlock); ok {
 					err = praseCodeBlock(sibling)
 				}
+				if htmlBlock, ok := sibling.(*ast.HTMLBlock); ok {
+					attributes, isMdxComment, parseErr := parseMdxComment(htmlBlock, source)
+					if parseErr != nil {
+						return ast.WalkStop, fmt.Errorf("command '%s' in '%s': %w", currentCommandBlock.Name, markdownFile, parseErr)
+					}
+					if isMdxComment {
+						for key, value := range attributes {
+							currentCommandBlock.Meta[key] = value
+						}
+					}
+				}
 				if err != nil {
 					return ast.WalkStop, err
 				}
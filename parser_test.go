@@ -53,6 +53,11 @@ func TestExtractCommandAndDepsFromHeading(t *testing.T) {
 			expectedCmd:  "commandName",
 			expectedDeps: []string{"dep1,", "dep2,", "dep3"},
 		},
+		{
+			heading:      "[deploy](build:{{ .env }},x migrate:prod)",
+			expectedCmd:  "deploy",
+			expectedDeps: []string{"build:{{ .env }},x", "migrate:prod"},
+		},
 	}
 
 	for _, test := range tests {
@@ -121,6 +126,25 @@ func RunFileParseTest(t *testing.T, tt *FileParseTest) {
 	})
 
 }
+func TestParseDependency(t *testing.T) {
+	tests := []struct {
+		dependency   string
+		expectedName string
+		expectedArgs []string
+	}{
+		{"build", "build", nil},
+		{"build:", "build", []string{}},
+		{"build:linux", "build", []string{"linux"}},
+		{"build:linux,{{ index .outputs \"setup\" \"VERSION\" }}", "build", []string{"linux", `{{ index .outputs "setup" "VERSION" }}`}},
+	}
+	for _, test := range tests {
+		name, args := parseDependency(test.dependency)
+		if name != test.expectedName || !reflect.DeepEqual(args, test.expectedArgs) {
+			t.Errorf("parseDependency(%q) = %q, %q; want %q, %q", test.dependency, name, args, test.expectedName, test.expectedArgs)
+		}
+	}
+}
+
 func TestOneCommandWithDeps(t *testing.T) {
 	test := &FileParseTest{
 		filePath: "tests/test1.md",
@@ -283,3 +307,109 @@ func TestNoCodeInCodeFence(t *testing.T) {
 	RunFileParseTest(t, test)
 
 }
+
+func TestParseAttributes(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    map[string]string
+		expectedErr error
+	}{
+		{
+			input:    "",
+			expected: map[string]string{},
+		},
+		{
+			input:    "timeout=5s retries=3",
+			expected: map[string]string{"timeout": "5s", "retries": "3"},
+		},
+		{
+			input:    ` message="hello \"world\"" if='eq os "linux"'  pipe `,
+			expected: map[string]string{"message": `hello "world"`, "if": `eq os "linux"`, "pipe": "true"},
+		},
+		{
+			input:       `message="hello`,
+			expectedErr: ErrInvalidAttribute,
+		},
+		{
+			input:       `message='hello'world`,
+			expectedErr: ErrInvalidAttribute,
+		},
+		{
+			input:       `=5s`,
+			expectedErr: ErrInvalidAttribute,
+		},
+	}
+
+	for _, test := range tests {
+		attributes, err := parseAttributes(test.input)
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("parseAttributes(%q) error = %v; want %v", test.input, err, test.expectedErr)
+			continue
+		}
+		if test.expectedErr == nil && !reflect.DeepEqual(attributes, test.expected) {
+			t.Errorf("parseAttributes(%q) = %v; want %v", test.input, attributes, test.expected)
+		}
+	}
+}
+
+func TestParseAttributesFromFile(t *testing.T) {
+	test := &FileParseTest{
+		filePath: "tests/attributes.md",
+		expectedCmds: map[string]CommandBlock{
+			"with_attributes": {
+				CodeBlocks: []CodeBlock{{
+					Lang: "sh",
+					Code: "code1",
+					Meta: map[string]interface{}{
+						"shebang": false,
+						"timeout": "5s",
+						"message": "hello world",
+						"if":      `eq os "linux"`,
+						"pipe":    "true",
+					},
+				}},
+				Dependencies: []string{"dep1"},
+				Meta:         map[string]interface{}{"timeout": "1m", "retries": "3", "note": "multi line comment"},
+			},
+			"plain_comment": {
+				CodeBlocks: []CodeBlock{{
+					Lang: "sh",
+					Code: "code2",
+					Meta: map[string]interface{}{"shebang": false},
+				}},
+				Dependencies: []string{},
+				Meta:         map[string]interface{}{},
+			},
+		},
+		expectedErr: nil,
+	}
+	RunFileParseTest(t, test)
+}
+
+func TestParseFileAttributes(t *testing.T) {
+	test := &FileParseTest{
+		filePath: "tests/file_attributes.md",
+		expectedCmds: map[string]CommandBlock{
+			"install": {
+				CodeBlocks: []CodeBlock{{
+					Lang: "sh",
+					Code: "helm install app --set tag=[[ .arg1 ]]",
+					Meta: map[string]interface{}{"shebang": false},
+				}},
+				Dependencies: []string{},
+				Meta:         map[string]interface{}{"delims": "[[ ]]"},
+			},
+			"workflow": {
+				CodeBlocks: []CodeBlock{{
+					Lang: "sh",
+					Code: "echo '${{ github.sha }}'",
+					Meta: map[string]interface{}{"shebang": false},
+				}},
+				Dependencies: []string{},
+				Meta:         map[string]interface{}{"delims": "[[ ]]", "template": "off"},
+			},
+		},
+		expectedErr: nil,
+	}
+	RunFileParseTest(t, test)
+}
@@ -0,0 +1,64 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// signals which cause mdx to stop the running code block
+var terminationSignals = []os.Signal{os.Interrupt}
+
+// signal sent to a code block which is cancelled for another reason than a received signal
+var stopSignal os.Signal = os.Kill
+
+// setProcessGroup is a no-op on platforms without process groups.
+func setProcessGroup(cmd *exec.Cmd) (restoreTerminal func()) {
+	return func() {}
+}
+
+// signalProcessGroup sends sig to the started cmd. Only killing is supported
+// on platforms without process groups, so every signal results in a kill.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}
+
+// interruptSignal always returns false, code blocks do not run in the foreground on this platform.
+func interruptSignal(err error) (os.Signal, bool) {
+	return nil, false
+}
+
+// execSelf runs mdx with the arguments argv and exits with its exit status,
+// replacing the process is not supported on this platform.
+func execSelf(argv []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, argv...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// brokenPipe always returns false, code blocks are not stopped by a broken pipe on this platform.
+func brokenPipe(err error) bool {
+	return false
+}
+
+// lockFile does nothing, files are not locked on this platform.
+func lockFile(file *os.File) error {
+	return nil
+}
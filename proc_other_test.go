@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// processRunning reports whether a process with pid exists, finding a process fails if it exited.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,109 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// signals which cause mdx to stop the running code block
+var terminationSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// signal sent to a code block which is cancelled for another reason than a received signal
+var stopSignal os.Signal = syscall.SIGTERM
+
+/*
+setProcessGroup places the process in a new process group, so it and all of its children can be signaled at once.
+
+If the process reads from the terminal mdx is the foreground process group of, the new process group becomes the
+foreground process group instead. Otherwise interactive programs are stopped as soon as they read from the terminal.
+The returned function hands the terminal back to mdx and must be called after the process exited.
+*/
+func setProcessGroup(cmd *exec.Cmd) (restoreTerminal func()) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	tty, ok := cmd.Stdin.(*os.File)
+	if !ok {
+		return func() {}
+	}
+	fd := int(tty.Fd())
+	if foreground, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP); err != nil || foreground != syscall.Getpgrp() {
+		return func() {}
+	}
+
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = fd
+	return func() {
+		// mdx is a background process group now, changing the foreground process group raises SIGTTOU
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, syscall.Getpgrp()); err != nil {
+			logrus.Debug(fmt.Sprintf("Failed to restore the foreground process group of the terminal: %v", err))
+		}
+	}
+}
+
+// signalProcessGroup sends sig to the process group led by the started cmd.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return cmd.Process.Signal(sig)
+	}
+	return syscall.Kill(-cmd.Process.Pid, s)
+}
+
+/*
+interruptSignal reports whether the process exited because of a SIGINT. When a code block runs
+in the foreground of the terminal, Ctrl-C is delivered to the code block instead of mdx.
+*/
+func interruptSignal(err error) (os.Signal, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGINT {
+		return nil, false
+	}
+	return status.Signal(), true
+}
+
+// execSelf replaces mdx with a new mdx process with the arguments argv.
+func execSelf(argv []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(executable, append([]string{os.Args[0]}, argv...), os.Environ())
+}
+
+/*
+brokenPipe reports whether the code block failed because the process reading its output exited:
+it was killed by SIGPIPE, a shell reported this with exit status 141, or its output could not be copied.
+*/
+func brokenPipe(err error) bool {
+	if errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGPIPE {
+		return true
+	}
+	return exitErr.ExitCode() == 128+int(syscall.SIGPIPE)
+}
+
+// lockFile locks file exclusively, waiting for other processes to release their lock.
+func lockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_EX)
+}
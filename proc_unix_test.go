@@ -0,0 +1,10 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// processRunning reports whether a process with pid exists.
+func processRunning(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces secrets in logs.
+const redacted = "***"
+
+// minSecretLength is the minimum length of a secret value, shorter values would mask too much unrelated text.
+const minSecretLength = 4
+
+// sensitiveEnvPattern matches the names of environment variables which usually hold secrets.
+var sensitiveEnvPattern = regexp.MustCompile(`(?i)(SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|PRIVATE_?KEY|CREDENTIAL)`)
+
+// redactor masks secrets, given as values or regular expressions, in text written to logs.
+type redactor struct {
+	mu       sync.RWMutex
+	values   []string
+	patterns []*regexp.Regexp
+}
+
+// global storage for the secrets of the invocation
+var redactions = &redactor{}
+
+// addValue masks value from now on. Values shorter than minSecretLength are ignored.
+func (r *redactor) addValue(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.values {
+		if existing == value {
+			return
+		}
+	}
+	r.values = append(r.values, value)
+}
+
+// addPattern masks all matches of pattern from now on.
+func (r *redactor) addPattern(pattern *regexp.Regexp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns = append(r.patterns, pattern)
+}
+
+// addEnvironment masks the values of the environment variables with names matching sensitiveEnvPattern.
+func (r *redactor) addEnvironment(environ []string) {
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if sensitiveEnvPattern.MatchString(name) {
+			r.addValue(value)
+		}
+	}
+}
+
+// redactAll returns values with all secrets replaced by redacted.
+func (r *redactor) redactAll(values []string) []string {
+	redactedValues := make([]string, len(values))
+	for i, value := range values {
+		redactedValues[i] = r.redact(value)
+	}
+	return redactedValues
+}
+
+// redactingFormatter masks secrets in the messages of mdx, which are formatted by Formatter.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+// Format implements logrus.Formatter.
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	formatted, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(redactions.redact(string(formatted))), nil
+}
+
+// redact returns s with all secrets replaced by redacted.
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, value := range r.values {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	for _, pattern := range r.patterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+	return s
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r := &redactor{}
+	r.addEnvironment([]string{"GITHUB_TOKEN=ghp_secret", "DB_PASSWORD=s3cr3t!", "HOME=/home/user", "API_KEY=abc"})
+	r.addPattern(regexp.MustCompile(`Bearer \S+`))
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"token ghp_secret used", "token *** used"},
+		{"login with s3cr3t!", "login with ***"},
+		{"home is /home/user", "home is /home/user"},
+		{"short values like abc are kept", "short values like abc are kept"},
+		{"Authorization: Bearer xyz123", "Authorization: ***"},
+	}
+
+	for _, tt := range tests {
+		if got := r.redact(tt.input); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// report formats
+const (
+	reportJUnit = "junit"
+	reportJSON  = "json"
+)
+
+// reportSpec is a report requested with --report format=path.
+type reportSpec struct {
+	format string
+	path   string
+}
+
+// reportFlag collects the values of the repeatable --report flag.
+type reportFlag []reportSpec
+
+func (f *reportFlag) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, spec := range *f {
+		specs = append(specs, spec.format+"="+spec.path)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *reportFlag) Set(value string) error {
+	format, path, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("expected format=path, e.g. junit=report.xml")
+	}
+	if format != reportJUnit && format != reportJSON {
+		return fmt.Errorf("unknown report format '%s': expected '%s' or '%s'", format, reportJUnit, reportJSON)
+	}
+	*f = append(*f, reportSpec{format: format, path: path})
+	return nil
+}
+
+// reportBlock is a code block in a report.
+type reportBlock struct {
+	Lang     string    `json:"lang"`
+	File     string    `json:"file"`
+	Line     int       `json:"line"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+}
+
+// reportCommand is a command in a report, with the code blocks executed by it.
+type reportCommand struct {
+	Name     string        `json:"name"`
+	File     string        `json:"file"`
+	Args     []string      `json:"args"`
+	Start    time.Time     `json:"start"`
+	Duration float64       `json:"duration_seconds"`
+	Error    string        `json:"error,omitempty"`
+	Blocks   []reportBlock `json:"blocks"`
+}
+
+// runReport is the report of one invocation of mdx.
+type runReport struct {
+	Start    time.Time       `json:"start"`
+	Duration float64         `json:"duration_seconds"`
+	Error    string          `json:"error,omitempty"`
+	Commands []reportCommand `json:"commands"`
+}
+
+// errorString returns the message of err, or an empty string if err is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+/*
+newRunReport builds the report of an invocation from the results recorded in state. The commands are
+in the order they finished, so dependencies come before the commands depending on them.
+Secrets are masked in the arguments, the errors and the output.
+*/
+func newRunReport(state *runState, start time.Time, err error) runReport {
+	report := runReport{
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+		Error:    redactions.redact(errorString(err)),
+		Commands: []reportCommand{},
+	}
+
+	blocks := make(map[*CommandBlock][]reportBlock)
+	for _, result := range state.getResults() {
+		blocks[result.command] = append(blocks[result.command], reportBlock{
+			Lang:     result.codeBlock.Lang,
+			File:     result.command.Filename,
+			Line:     result.codeBlock.Line,
+			Start:    result.start,
+			Duration: result.duration.Seconds(),
+			ExitCode: result.exitCode,
+			Error:    redactions.redact(errorString(result.err)),
+			Stdout:   redactions.redact(string(result.stdout)),
+			Stderr:   redactions.redact(string(result.stderr)),
+		})
+	}
+
+	for _, result := range state.getCommandResults() {
+		command := reportCommand{
+			Name:     result.command.Name,
+			File:     result.command.Filename,
+			Args:     redactions.redactAll(result.args),
+			Start:    result.start,
+			Duration: result.duration.Seconds(),
+			Error:    redactions.redact(errorString(result.err)),
+			Blocks:   blocks[result.command],
+		}
+		if command.Blocks == nil {
+			command.Blocks = []reportBlock{}
+		}
+		report.Commands = append(report.Commands, command)
+	}
+	return report
+}
+
+// junitFailure is the failure of a JUnit test case.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitTestCase is a code block in a JUnit report.
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+// junitTestSuite is a command in a JUnit report.
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	File      string          `xml:"file,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// junitTestSuites is the root element of a JUnit report.
+type junitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Errors     int              `xml:"errors,attr"`
+	Time       string           `xml:"time,attr"`
+	TestSuites []junitTestSuite `xml:"testsuite"`
+}
+
+// junitSeconds formats a duration in seconds for the time attributes of a JUnit report.
+func junitSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+/*
+junitReport converts report into the JUnit XML format: every command is a test suite and every
+code block a test case. A command failing without a failed code block, e.g. because of an
+invalid attribute, counts as an error of its test suite.
+*/
+func junitReport(report runReport) junitTestSuites {
+	suites := junitTestSuites{Name: "mdx", Time: junitSeconds(report.Duration)}
+	for _, command := range report.Commands {
+		suite := junitTestSuite{
+			Name:      command.Name,
+			Time:      junitSeconds(command.Duration),
+			Timestamp: command.Start.UTC().Format(time.RFC3339),
+			File:      command.File,
+			TestCases: []junitTestCase{},
+		}
+		blockFailed := false
+		for _, block := range command.Blocks {
+			testCase := junitTestCase{
+				Name:      fmt.Sprintf("%s:%d (%s)", block.File, block.Line, block.Lang),
+				Classname: command.Name,
+				File:      block.File,
+				Line:      block.Line,
+				Time:      junitSeconds(block.Duration),
+				SystemOut: block.Stdout,
+				SystemErr: block.Stderr,
+			}
+			if block.Error != "" {
+				testCase.Failure = &junitFailure{
+					Message: block.Error,
+					Type:    fmt.Sprintf("exit status %d", block.ExitCode),
+					Text:    block.Stderr,
+				}
+				suite.Failures++
+				blockFailed = true
+			}
+			suite.TestCases = append(suite.TestCases, testCase)
+		}
+		if command.Error != "" && !blockFailed {
+			suite.Errors++
+		}
+		suite.Tests = len(suite.TestCases)
+
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Errors += suite.Errors
+		suites.TestSuites = append(suites.TestSuites, suite)
+	}
+	return suites
+}
+
+// writeReports writes report to the files requested with --report.
+func writeReports(specs []reportSpec, report runReport) error {
+	for _, spec := range specs {
+		var data []byte
+		var err error
+		switch spec.format {
+		case reportJUnit:
+			data, err = xml.MarshalIndent(junitReport(report), "", "  ")
+			data = append([]byte(xml.Header), data...)
+		case reportJSON:
+			data, err = json.MarshalIndent(report, "", "  ")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode %s report: %w", spec.format, err)
+		}
+		if err := os.WriteFile(spec.path, append(data, '\n'), 0o644); err != nil {
+			return fmt.Errorf("failed to write %s report: %w", spec.format, err)
+		}
+	}
+	return nil
+}
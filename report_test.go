@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReportFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"junit=report.xml", false},
+		{"json=out/report.json", false},
+		{"junit", true},
+		{"json=", true},
+		{"html=report.html", true},
+	}
+
+	for _, tt := range tests {
+		var reports reportFlag
+		err := reports.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("reportFlag.Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"setup": {
+			Name:       "setup",
+			Filename:   "ci.md",
+			CodeBlocks: []CodeBlock{{Lang: "sh", Code: "echo setup", Line: 3, Meta: map[string]any{"shebang": false}}},
+			Meta:       map[string]any{},
+		},
+		"ci": {
+			Name:         "ci",
+			Filename:     "ci.md",
+			Dependencies: []string{"setup"},
+			CodeBlocks: []CodeBlock{
+				{Lang: "sh", Code: "echo building; echo warning >&2", Line: 9, Meta: map[string]any{"shebang": false}},
+				{Lang: "sh", Code: "exit 4", Line: 14, Meta: map[string]any{"shebang": false}},
+			},
+			Meta: map[string]any{},
+		},
+	}
+
+	var state *runState
+	start := time.Now()
+	command := commands["ci"]
+	_, err := captureOutput(func() error {
+		state = newRunState()
+		state.recordOutput = true
+		return executeCommandBlock(withRunState(context.Background(), state), commands, &command)
+	})
+	if err == nil {
+		t.Fatal("executeCommandBlock() error = nil, want an error")
+	}
+
+	dir := t.TempDir()
+	specs := []reportSpec{{reportJSON, filepath.Join(dir, "report.json")}, {reportJUnit, filepath.Join(dir, "report.xml")}}
+	if err := writeReports(specs, newRunReport(state, start, err)); err != nil {
+		t.Fatalf("writeReports() error = %v", err)
+	}
+
+	data, err := os.ReadFile(specs[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report runReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("invalid json report: %v", err)
+	}
+	if len(report.Commands) != 2 || report.Commands[0].Name != "setup" || report.Commands[1].Name != "ci" {
+		t.Fatalf("json report commands = %+v, want setup and ci", report.Commands)
+	}
+	blocks := report.Commands[1].Blocks
+	if len(blocks) != 2 || blocks[0].Stdout != "building\n" || blocks[0].Stderr != "warning\n" || blocks[1].ExitCode != 4 || blocks[1].Line != 14 {
+		t.Errorf("json report blocks of ci = %+v", blocks)
+	}
+
+	data, err = os.ReadFile(specs[1].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		t.Fatalf("invalid junit report: %v", err)
+	}
+	if suites.Tests != 3 || suites.Failures != 1 || len(suites.TestSuites) != 2 {
+		t.Errorf("junit report has %d tests, %d failures and %d suites, want 3, 1 and 2", suites.Tests, suites.Failures, len(suites.TestSuites))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+retryPolicy describes how often a failed code block is executed again. It is configured with attributes
+on the code block or on its command, the attributes of the code block take precedence:
+
+	retries=3         execute the code block up to 3 more times
+	retry_delay=2s    wait 2s before the first retry (default: 1s)
+	retry_backoff=2   multiply the delay by 2 after every retry (default: 1)
+	retry_on="1 75"   only retry if the code block exited with one of these exit codes (default: any failure)
+*/
+type retryPolicy struct {
+	retries   int
+	delay     time.Duration
+	backoff   float64
+	exitCodes map[int]struct{}
+}
+
+// blockAttribute returns the attribute of the code block, or the attribute of the command if the code block does not set it.
+func blockAttribute(commandBlock *CommandBlock, codeBlock *CodeBlock, key string) (string, bool) {
+	if value, ok := metaString(codeBlock.Meta, key); ok {
+		return value, true
+	}
+	return metaString(commandBlock.Meta, key)
+}
+
+func getRetryPolicy(commandBlock *CommandBlock, codeBlock *CodeBlock) (retryPolicy, error) {
+	policy := retryPolicy{delay: time.Second, backoff: 1}
+
+	if value, ok := blockAttribute(commandBlock, codeBlock, "retries"); ok {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return policy, fmt.Errorf("%w: retries=%s: expected a positive number", ErrInvalidAttribute, value)
+		}
+		policy.retries = retries
+	}
+
+	if value, ok := blockAttribute(commandBlock, codeBlock, "retry_delay"); ok {
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			return policy, fmt.Errorf("%w: retry_delay=%s: %v", ErrInvalidAttribute, value, err)
+		}
+		policy.delay = delay
+	}
+
+	if value, ok := blockAttribute(commandBlock, codeBlock, "retry_backoff"); ok {
+		backoff, err := strconv.ParseFloat(value, 64)
+		if err != nil || backoff < 1 {
+			return policy, fmt.Errorf("%w: retry_backoff=%s: expected a number >= 1", ErrInvalidAttribute, value)
+		}
+		policy.backoff = backoff
+	}
+
+	if value, ok := blockAttribute(commandBlock, codeBlock, "retry_on"); ok {
+		policy.exitCodes = make(map[int]struct{})
+		for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			exitCode, err := strconv.Atoi(field)
+			if err != nil {
+				return policy, fmt.Errorf("%w: retry_on=%s: expected a list of exit codes", ErrInvalidAttribute, value)
+			}
+			policy.exitCodes[exitCode] = struct{}{}
+		}
+	}
+
+	return policy, nil
+}
+
+/*
+shouldRetry reports whether the failure err of an attempt can be retried.
+Only failures of the executed code are retried, errors like missing arguments would fail again.
+*/
+func (p retryPolicy) shouldRetry(err error) bool {
+	if p.exitCodes == nil {
+		return errors.Is(err, ErrExecutionFailed) || errors.Is(err, ErrTimeout)
+	}
+
+	_, ok := p.exitCodes[exitCode(err)]
+	return ok
+}
+
+// retryError is returned if a code block failed in every attempt. It contains the errors of all attempts.
+type retryError struct {
+	attempts []error
+}
+
+func (e *retryError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v (%d attempts)", ErrRetriesExhausted, len(e.attempts))
+	for i, err := range e.attempts {
+		fmt.Fprintf(&b, "\n  attempt %d: %v", i+1, err)
+	}
+	return b.String()
+}
+
+func (e *retryError) Unwrap() []error {
+	return []error{ErrRetriesExhausted, e.attempts[len(e.attempts)-1]}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecuteCodeBlock_RetrySucceeds(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	counter := filepath.Join(t.TempDir(), "counter")
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: fmt.Sprintf(`echo -n x >> %s; [ "$(cat %s)" = "xxx" ] && echo -n done`, counter, counter),
+		Meta: map[string]interface{}{"shebang": false, "retry_delay": "10ms"},
+	}
+	commandBlock := CommandBlock{Name: "flaky", Meta: map[string]interface{}{"retries": "3"}}
+
+	output, err := captureOutput(func() error {
+		return executeCodeBlock(context.Background(), &commandBlock, &codeBlock)
+	})
+
+	if err != nil {
+		t.Errorf("executeCodeBlock() error = %v, wantErr %v", err, nil)
+	}
+	if !strings.HasSuffix(output, "done") {
+		t.Errorf("executeCodeBlock() output = %v, expected the third attempt to succeed", output)
+	}
+}
+
+func TestExecuteCodeBlock_RetriesExhausted(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `exit 75`,
+		Meta: map[string]interface{}{"shebang": false, "retries": "2", "retry_delay": "10ms", "retry_backoff": "2", "retry_on": "75"},
+	}
+	wantErr := ErrRetriesExhausted
+
+	_, err := captureOutput(func() error {
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+	})
+
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("executeCodeBlock() error = %v, wantErr %v", err, wantErr)
+	}
+	var retryErr *retryError
+	if !errors.As(err, &retryErr) || len(retryErr.attempts) != 3 {
+		t.Errorf("executeCodeBlock() error = %v, expected 3 attempts", err)
+	}
+}
+
+func TestExecuteCodeBlock_RetryOnOtherExitCode(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	codeBlock := CodeBlock{
+		Lang: "sh",
+		Code: `exit 1`,
+		Meta: map[string]interface{}{"shebang": false, "retries": "2", "retry_delay": "10ms", "retry_on": "75"},
+	}
+	wantErr := ErrExecutionFailed
+
+	_, err := captureOutput(func() error {
+		return executeCodeBlock(context.Background(), &CommandBlock{}, &codeBlock)
+	})
+
+	if !errors.Is(err, wantErr) || errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("executeCodeBlock() error = %v, expected a single attempt failing with %v", err, wantErr)
+	}
+}
+
+func TestGetRetryPolicy_Invalid(t *testing.T) {
+	tests := []map[string]interface{}{
+		{"retries": "many"},
+		{"retry_delay": "1"},
+		{"retry_backoff": "0.5"},
+		{"retry_on": "error"},
+	}
+
+	for _, meta := range tests {
+		_, err := getRetryPolicy(&CommandBlock{Meta: meta}, &CodeBlock{})
+		if !errors.Is(err, ErrInvalidAttribute) {
+			t.Errorf("getRetryPolicy(%v) error = %v, wantErr %v", meta, err, ErrInvalidAttribute)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// runState holds the state of one invocation of mdx, which is shared by all executed commands.
+type runState struct {
+	mu           sync.Mutex
+	outputs      map[string]map[string]string // outputs of the executed commands, by command name and output name
+	env          map[string]string            // outputs by output name, as exported to the environment of later code blocks
+	recordOutput bool                         // record the output of code blocks in their results
+	results      []blockResult                // results of the executed code blocks, in order of execution
+	skipped      []blockResult                // code blocks skipped because of their condition, without a result
+	commands     []commandResult              // results of the executed commands, in order of completion
+	stdout       io.Writer                    // where code blocks write their stdout to, os.Stdout by default
+	stderr       io.Writer                    // where code blocks write their stderr to, os.Stderr by default
+	events       eventHandler                 // receives the execution events, if set
+	logs         *logFiles                    // receives the output of code blocks, if a log file is written
+	services     []*service                   // services started in this invocation, in order of their start
+	executed     map[string]error             // results of the executed commands, by commandKey
+	planned      map[string]bool              // names of the commands executed in this invocation, see plannedCommands
+}
+
+// blockResult is the result of the execution of a code block.
+type blockResult struct {
+	command   *CommandBlock
+	codeBlock *CodeBlock
+	start     time.Time
+	duration  time.Duration
+	exitCode  int    // exit code of the code block, -1 if it did not exit normally
+	err       error  // nil if the code block succeeded
+	output    []byte // stdout and stderr of the code block, only recorded if recordOutput is set
+	stdout    []byte // stdout of the code block, only recorded if recordOutput is set
+	stderr    []byte // stderr of the code block, only recorded if recordOutput is set
+}
+
+// commandResult is the result of the execution of a command, without its dependencies.
+type commandResult struct {
+	command  *CommandBlock
+	args     []string
+	start    time.Time
+	duration time.Duration
+	err      error // nil if the command succeeded
+}
+
+// exitCode returns the exit code for the error returned by the execution of a code block.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	var statusErr *exitStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status
+	}
+	return -1
+}
+
+// addResult records the result of an executed code block.
+func (s *runState) addResult(result blockResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, result)
+}
+
+// getResults returns the results of all executed code blocks.
+func (s *runState) getResults() []blockResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]blockResult{}, s.results...)
+}
+
+// addCommandResult records the result of an executed command.
+func (s *runState) addCommandResult(result commandResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, result)
+}
+
+// getCommandResults returns the results of all executed commands.
+func (s *runState) getCommandResults() []commandResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]commandResult{}, s.commands...)
+}
+
+// lockedBuffer is a buffer which can be written to by the stdout and stderr of a code block concurrently.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.buf...)
+}
+
+// recorder records the output of a code block, combined and per stream.
+type recorder struct {
+	output lockedBuffer
+	stdout lockedBuffer
+	stderr lockedBuffer
+}
+
+// tee returns writers which write to stdout and stderr and record everything written.
+func (r *recorder) tee(stdout io.Writer, stderr io.Writer) (io.Writer, io.Writer) {
+	return io.MultiWriter(stdout, &r.output, &r.stdout), io.MultiWriter(stderr, &r.output, &r.stderr)
+}
+
+// fill sets the recorded output of result. A nil recorder leaves result unchanged.
+func (r *recorder) fill(result *blockResult) {
+	if r == nil {
+		return
+	}
+	result.output = r.output.Bytes()
+	result.stdout = r.stdout.Bytes()
+	result.stderr = r.stderr.Bytes()
+}
+
+func newRunState() *runState {
+	return &runState{
+		outputs:  make(map[string]map[string]string),
+		env:      make(map[string]string),
+		executed: make(map[string]error),
+		planned:  make(map[string]bool),
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+	}
+}
+
+type runStateKey struct{}
+
+// withRunState returns a context which carries state to all commands and code blocks executed with it.
+func withRunState(ctx context.Context, state *runState) context.Context {
+	return context.WithValue(ctx, runStateKey{}, state)
+}
+
+// getRunState returns the state carried by ctx. A new state is returned if ctx does not carry one.
+func getRunState(ctx context.Context) *runState {
+	if state, ok := ctx.Value(runStateKey{}).(*runState); ok {
+		return state
+	}
+	return newRunState()
+}
+
+// setOutputs records the outputs of a code block of command.
+func (s *runState) setOutputs(command string, outputs map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.outputs[command] == nil {
+		s.outputs[command] = make(map[string]string)
+	}
+	for name, value := range outputs {
+		s.outputs[command][name] = value
+		s.env[name] = value
+	}
+}
+
+// outputsSnapshot returns a copy of the outputs of all executed commands, used as .outputs in templates.
+func (s *runState) outputsSnapshot() map[string]map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]map[string]string, len(s.outputs))
+	for command, outputs := range s.outputs {
+		snapshot[command] = make(map[string]string, len(outputs))
+		for name, value := range outputs {
+			snapshot[command][name] = value
+		}
+	}
+	return snapshot
+}
+
+// outputEnv returns the outputs of all executed commands as environment variables.
+func (s *runState) outputEnv() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	env := make([]string, 0, len(s.env))
+	for name, value := range s.env {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// providers of secrets, selected with -secrets-provider or a prefix like {{secret "pass:db/password"}}
+const (
+	secretProviderEnv  = "env"  // environment variables, db/password is read from DB_PASSWORD
+	secretProviderFile = "file" // files in settings.SecretsDir, db/password is read from .secrets/db/password
+	secretProviderPass = "pass" // the password store, with pass show db/password
+	secretProviderAge  = "age"  // NAME=value lines in settings.SecretsFile, encrypted with age
+	secretProviderGPG  = "gpg"  // NAME=value lines in settings.SecretsFile, encrypted with gpg
+	secretProviderExec = "exec" // the output of settings.SecretsCommand, which receives the name as argument
+)
+
+var secretProviders = []string{secretProviderEnv, secretProviderFile, secretProviderPass, secretProviderAge, secretProviderGPG, secretProviderExec}
+
+// secretEnvInvalid matches the characters of secret names which are replaced by _ in environment variable names.
+var secretEnvInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+/*
+secretStore resolves the secrets of an invocation and caches them, so every secret is read at most once
+and an encrypted file is decrypted at most once. Every resolved value is masked with redactions.
+*/
+type secretStore struct {
+	mu        sync.Mutex
+	values    map[string]string
+	decrypted map[string]map[string]string
+}
+
+// global storage for the secrets of the invocation
+var secrets = &secretStore{}
+
+/*
+resolve returns the secret referenced by ref, which is a name like db/password for the provider
+settings.SecretsProvider or a name with the provider as prefix, like pass:db/password.
+Relative files are resolved in dir.
+*/
+func (s *secretStore) resolve(ctx context.Context, dir string, ref string) (string, error) {
+	provider, name := settings.SecretsProvider, ref
+	if prefix, rest, ok := strings.Cut(ref, ":"); ok && slices.Contains(secretProviders, prefix) {
+		provider, name = prefix, rest
+	}
+	if provider == "" {
+		provider = secretProviderEnv
+	}
+	if !slices.Contains(secretProviders, provider) {
+		return "", fmt.Errorf("%w: unknown provider '%s', expected one of %s", ErrSecretNotFound, provider, strings.Join(secretProviders, ", "))
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w: the name of the secret is empty", ErrSecretNotFound)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := provider + ":" + name
+	if value, ok := s.values[key]; ok {
+		return value, nil
+	}
+
+	var value string
+	var err error
+	switch provider {
+	case secretProviderEnv:
+		envName := strings.ToUpper(secretEnvInvalid.ReplaceAllString(name, "_"))
+		var ok bool
+		if value, ok = os.LookupEnv(envName); !ok {
+			err = fmt.Errorf("environment variable %s is not set", envName)
+		}
+	case secretProviderFile:
+		value, err = readSecretFile(dir, name)
+	case secretProviderPass:
+		value, err = secretCommand(ctx, dir, "pass", "show", name)
+		value, _, _ = strings.Cut(value, "\n")
+	case secretProviderAge, secretProviderGPG:
+		value, err = s.decryptedSecret(ctx, dir, provider, name)
+	case secretProviderExec:
+		if settings.SecretsCommand == "" {
+			err = fmt.Errorf("no secrets command is set, see -secrets-command")
+			break
+		}
+		value, err = secretCommand(ctx, dir, "sh", "-c", settings.SecretsCommand+` "$@"`, "sh", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: '%s' from provider '%s': %v", ErrSecretNotFound, name, provider, err)
+	}
+
+	logrus.Debug(fmt.Sprintf("Resolved secret '%s' from provider '%s'", name, provider))
+	redactions.addValue(value)
+	if s.values == nil {
+		s.values = make(map[string]string)
+	}
+	s.values[key] = value
+	return value, nil
+}
+
+// readSecretFile returns the content of the file name in settings.SecretsDir, without the trailing line break.
+func readSecretFile(dir string, name string) (string, error) {
+	secretsDir := settings.SecretsDir
+	if !filepath.IsAbs(secretsDir) {
+		secretsDir = filepath.Join(dir, secretsDir)
+	}
+	path := filepath.Join(secretsDir, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, filepath.Clean(secretsDir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside of the secrets directory", name)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// secretCommand returns the output of a command which prints a secret, without the trailing line break.
+func secretCommand(ctx context.Context, dir string, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%v: %s", err, message)
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+/*
+decryptedSecret returns the secret name from settings.SecretsFile, which is decrypted with age or gpg.
+The decrypted file contains NAME=value lines, empty lines and comments starting with #, like a .env file.
+age uses the identity file in MDX_AGE_IDENTITY, if it is set. Callers hold s.mu.
+*/
+func (s *secretStore) decryptedSecret(ctx context.Context, dir string, provider string, name string) (string, error) {
+	if settings.SecretsFile == "" {
+		return "", fmt.Errorf("no secrets file is set, see -secrets-file")
+	}
+	path := settings.SecretsFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	values, ok := s.decrypted[path]
+	if !ok {
+		var content string
+		var err error
+		if provider == secretProviderAge {
+			args := []string{"--decrypt"}
+			if identity := os.Getenv("MDX_AGE_IDENTITY"); identity != "" {
+				args = append(args, "--identity", identity)
+			}
+			content, err = secretCommand(ctx, dir, "age", append(args, path)...)
+		} else {
+			content, err = secretCommand(ctx, dir, "gpg", "--quiet", "--batch", "--decrypt", path)
+		}
+		if err != nil {
+			return "", err
+		}
+		values = parseSecretsFile(content)
+		for _, value := range values {
+			redactions.addValue(value)
+		}
+		if s.decrypted == nil {
+			s.decrypted = make(map[string]map[string]string)
+		}
+		s.decrypted[path] = values
+	}
+
+	value, ok := values[name]
+	if !ok {
+		return "", fmt.Errorf("'%s' is not defined in '%s'", name, settings.SecretsFile)
+	}
+	return value, nil
+}
+
+// parseSecretsFile returns the NAME=value lines of a decrypted secrets file.
+func parseSecretsFile(content string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, value, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
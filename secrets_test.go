@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resetSecrets isolates the secrets, redactions and secret settings of a test.
+func resetSecrets(t *testing.T) {
+	previousSecrets, previousRedactions, previousSettings := secrets, redactions, settings
+	secrets, redactions = &secretStore{}, &redactor{}
+	t.Cleanup(func() {
+		secrets, redactions, settings = previousSecrets, previousRedactions, previousSettings
+	})
+}
+
+func TestSecretStore_Resolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".secrets", "db"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".secrets", "db", "password"), []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DB_PASSWORD", "env-secret")
+
+	tests := []struct {
+		name     string
+		provider string
+		command  string
+		ref      string
+		want     string
+		wantErr  error
+	}{
+		{name: "Env", provider: "env", ref: "db/password", want: "env-secret"},
+		{name: "EnvMissing", provider: "env", ref: "db/user", wantErr: ErrSecretNotFound},
+		{name: "File", provider: "file", ref: "db/password", want: "file-secret"},
+		{name: "FileOutsideDir", provider: "file", ref: "../db/password", wantErr: ErrSecretNotFound},
+		{name: "Prefix", provider: "env", ref: "file:db/password", want: "file-secret"},
+		{name: "Exec", provider: "exec", command: "printf 'exec-%s\\n'", ref: "db/password", want: "exec-db/password"},
+		{name: "ExecFailing", provider: "exec", command: "exit 1", ref: "db/password", wantErr: ErrSecretNotFound},
+		{name: "ExecWithoutCommand", provider: "exec", ref: "db/password", wantErr: ErrSecretNotFound},
+		{name: "EncryptedWithoutFile", provider: "age", ref: "db/password", wantErr: ErrSecretNotFound},
+		{name: "UnknownProvider", provider: "vault", ref: "db/password", wantErr: ErrSecretNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSecrets(t)
+			settings.SecretsProvider = tt.provider
+			settings.SecretsCommand = tt.command
+
+			got, err := secrets.resolve(context.Background(), dir, tt.ref)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolve() = %q, want %q", got, tt.want)
+			}
+			if tt.want != "" && redactions.redact(got) != redacted {
+				t.Errorf("redact(%q) = %q, want the secret to be masked", got, redactions.redact(got))
+			}
+		})
+	}
+}
+
+func TestParseSecretsFile(t *testing.T) {
+	content := "# database\nDB_PASSWORD=s3cr3t\n\n db/user = admin \nINVALID\n"
+	want := map[string]string{"DB_PASSWORD": "s3cr3t", "db/user": "admin"}
+	if got := parseSecretsFile(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSecretsFile() = %v, want %v", got, want)
+	}
+}
+
+func TestExecuteCommandBlock_SecretMasked(t *testing.T) {
+	resetSecrets(t)
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	t.Setenv("DEPLOY_KEY", "k3y-for-deploy")
+	commands := map[string]CommandBlock{
+		"deploy": {
+			Name: "deploy",
+			CodeBlocks: []CodeBlock{{
+				Lang: "sh",
+				Code: `test "{{secret "deploy/key"}}" = "$DEPLOY_KEY" && echo injected && exit 1`,
+				Meta: map[string]any{"shebang": false},
+			}},
+			Meta: map[string]any{},
+		},
+	}
+
+	command := commands["deploy"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &command)
+	})
+	if !errors.Is(err, ErrExecutionFailed) {
+		t.Errorf("executeCommandBlock() error = %v, want %v", err, ErrExecutionFailed)
+	}
+	if !strings.Contains(output, "injected") || !strings.Contains(output, "Content of tmpFile") {
+		t.Errorf("output = %q, want the secret to be injected and the code block to be dumped", output)
+	}
+	if strings.Contains(output, "k3y-for-deploy") || !strings.Contains(output, `test "***"`) {
+		t.Errorf("output = %q, want the secret to be masked", output)
+	}
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	resetSecrets(t)
+	redactions.addValue("s3cr3t-value")
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(redactingFormatter{&logrus.TextFormatter{DisableColors: true}})
+	logger.Error("login with s3cr3t-value failed")
+
+	if strings.Contains(buf.String(), "s3cr3t-value") || !strings.Contains(buf.String(), "login with *** failed") {
+		t.Errorf("message = %q, want the secret to be masked", buf.String())
+	}
+}
+
+func TestRunCommand_SecretsMasked(t *testing.T) {
+	resetSecrets(t)
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	dir := t.TempDir()
+	t.Setenv("DB_PASSWORD", "hunter22")
+	t.Setenv("XDG_STATE_HOME", dir)
+	t.Setenv("MDX_HISTORY", "on")
+	settings.Events = "jsonl=" + filepath.Join(dir, "events.jsonl")
+	settings.HistoryOutput = true
+	settings.Reports = nil
+	for _, report := range []string{"json=" + filepath.Join(dir, "report.json"), "junit=" + filepath.Join(dir, "report.xml")} {
+		if err := settings.Reports.Set(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commands := map[string]CommandBlock{
+		"login": {
+			Name:     "login",
+			Filename: filepath.Join(dir, "runbook.md"),
+			CodeBlocks: []CodeBlock{{
+				Lang: "sh",
+				Code: `echo "password {{secret "db/password"}} for {{.arg1}}"; echo "{{secret "db/password"}}" >&2; exit 1`,
+				Meta: map[string]any{"shebang": false},
+			}},
+			Meta: map[string]any{},
+		},
+	}
+	command := commands["login"]
+	previousArgs := os.Args
+	os.Args = []string{"mdx", "login", "hunter22"}
+	t.Cleanup(func() { os.Args = previousArgs })
+	var err error
+	captureOutput(func() error {
+		err = runCommand(commands, &command, []string{"admin"}, false)
+		return nil
+	})
+	if !errors.Is(err, ErrExecutionFailed) {
+		t.Fatalf("runCommand() error = %v, want %v", err, ErrExecutionFailed)
+	}
+	err = fmt.Errorf("%w: hunter22", err)
+
+	historyFile, _ := historyPath()
+	var stderr bytes.Buffer
+	printCommandError(&stderr, err)
+	sinks := map[string]func() string{
+		"History":     func() string { return readTestFile(t, historyFile) },
+		"JSONReport":  func() string { return readTestFile(t, filepath.Join(dir, "report.json")) },
+		"JUnitReport": func() string { return readTestFile(t, filepath.Join(dir, "report.xml")) },
+		"Events":      func() string { return readTestFile(t, filepath.Join(dir, "events.jsonl")) },
+		"Trace": func() string {
+			state := newRunState()
+			state.addCommandResult(commandResult{command: &command, args: []string{"hunter22"}, err: err})
+			data, _ := json.Marshal(traceEvents(state, time.Now()))
+			return string(data)
+		},
+		"CommandError": func() string {
+			return stderr.String()
+		},
+	}
+	t.Run("Rerun", func(t *testing.T) {
+		entries, readErr := readHistory(historyFile)
+		if readErr != nil || len(entries) != 1 || !entries[0].Redacted {
+			t.Fatalf("readHistory() = %+v, %v, want one entry with masked arguments", entries, readErr)
+		}
+		if err := rerun(entries[0]); !errors.Is(err, ErrRerunNotPossible) {
+			t.Errorf("rerun() error = %v, want %v", err, ErrRerunNotPossible)
+		}
+	})
+	for name, sink := range sinks {
+		t.Run(name, func(t *testing.T) {
+			content := sink()
+			if strings.Contains(content, "hunter22") || !strings.Contains(content, redacted) {
+				t.Errorf("content = %q, want the secret to be masked", content)
+			}
+		})
+	}
+}
+
+// readTestFile returns the content of the file at path.
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// how long mdx waits for a service to become ready, unless ready_timeout is set
+	defaultReadyTimeout = 30 * time.Second
+	// how often the readiness probes of a service are checked
+	readyInterval = 200 * time.Millisecond
+	// how long a single readiness probe may take
+	probeTimeout = 2 * time.Second
+)
+
+/*
+readinessProbe describes when a service is ready to be used by its dependents. It is configured with
+attributes on the last code block of the service or on its command. All configured probes must succeed:
+
+	ready_port=5432                         a TCP connection to localhost:5432 can be established
+	ready_url=http://localhost:8080/health  a GET request returns a status below 400
+	ready_log="listening on"                a line of the output matches the regular expression
+	ready_cmd="pg_isready -q"               the shell command exits with status 0
+	ready_timeout=1m                        fail if the service is not ready after 1m (default: 30s)
+
+Without a probe, the service is ready as soon as it started.
+*/
+type readinessProbe struct {
+	address string
+	url     string
+	log     *regexp.Regexp
+	command string
+	timeout time.Duration
+}
+
+func getReadinessProbe(commandBlock *CommandBlock, codeBlock *CodeBlock) (readinessProbe, error) {
+	probe := readinessProbe{timeout: defaultReadyTimeout}
+
+	if port, ok := blockAttribute(commandBlock, codeBlock, "ready_port"); ok {
+		probe.address = port
+		if !strings.Contains(port, ":") {
+			probe.address = net.JoinHostPort("localhost", port)
+		}
+		if _, _, err := net.SplitHostPort(probe.address); err != nil {
+			return probe, fmt.Errorf("%w: ready_port=%s: %v", ErrInvalidAttribute, port, err)
+		}
+	}
+	if url, ok := blockAttribute(commandBlock, codeBlock, "ready_url"); ok {
+		probe.url = url
+		if !strings.Contains(url, "://") {
+			probe.url = "http://" + url
+		}
+	}
+	if pattern, ok := blockAttribute(commandBlock, codeBlock, "ready_log"); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return probe, fmt.Errorf("%w: ready_log=%s: %v", ErrInvalidAttribute, pattern, err)
+		}
+		probe.log = re
+	}
+	probe.command, _ = blockAttribute(commandBlock, codeBlock, "ready_cmd")
+	if value, ok := blockAttribute(commandBlock, codeBlock, "ready_timeout"); ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return probe, fmt.Errorf("%w: ready_timeout=%s: expected a positive duration", ErrInvalidAttribute, value)
+		}
+		probe.timeout = timeout
+	}
+	return probe, nil
+}
+
+// service is the last code block of a service command, which keeps running in the background.
+type service struct {
+	command   *CommandBlock
+	codeBlock *CodeBlock
+	cmd       *exec.Cmd
+	script    string
+	start     time.Time
+	exited    chan struct{} // closed when the process exited
+	waitErr   error         // the result of cmd.Wait, set before exited is closed
+	err       error         // set if the service did not become ready
+	recorded  *recorder
+	flushLog  func()
+	logged    atomic.Bool // set when a line of the output matched the ready_log pattern
+}
+
+/*
+startService starts codeBlock, the last code block of the service commandBlock, in the background and waits
+until it is ready. The service keeps running until stopServices is called at the end of the invocation,
+also if it did not become ready.
+*/
+func startService(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock, args ...string) error {
+	state := getRunState(ctx)
+	s := &service{command: commandBlock, codeBlock: codeBlock, start: time.Now(), exited: make(chan struct{}), flushLog: func() {}}
+	state.emit(blockEvent(eventBlockStarted, commandBlock, codeBlock))
+
+	probe, err := getReadinessProbe(commandBlock, codeBlock)
+	if err == nil {
+		err = s.launch(ctx, probe, args...)
+	}
+	if err != nil {
+		s.finish(state, err)
+		return err
+	}
+	state.addService(s)
+
+	if err := s.waitReady(ctx, probe); err != nil {
+		s.err = err
+		return err
+	}
+	logrus.Info(fmt.Sprintf("Service '%s' is ready after %v", commandBlock.Name, time.Since(s.start).Round(time.Millisecond)))
+	return nil
+}
+
+// launch starts the process of the service. It does not read from the stdin of mdx.
+func (s *service) launch(ctx context.Context, probe readinessProbe, args ...string) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	state := getRunState(ctx)
+	aio := attemptIO{stdout: state.stdout, stderr: state.stderr}
+	if state.recordOutput {
+		s.recorded = &recorder{}
+		aio.stdout, aio.stderr = s.recorded.tee(aio.stdout, aio.stderr)
+	}
+	aio.stdout, aio.stderr = state.teeEvents(s.command, s.codeBlock, aio.stdout, aio.stderr)
+	aio.stdout, aio.stderr, s.flushLog = state.teeLog(s.command, aio.stdout, aio.stderr)
+	if probe.log != nil {
+		aio.stdout = io.MultiWriter(aio.stdout, &lineMatcher{service: s, pattern: probe.log})
+		aio.stderr = io.MultiWriter(aio.stderr, &lineMatcher{service: s, pattern: probe.log})
+	}
+
+	cmd, script, err := prepareCodeBlock(ctx, s.command, s.codeBlock, aio, args...)
+	if err != nil {
+		return err
+	}
+	s.cmd, s.script = cmd, script
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		os.Remove(script)
+		return err
+	}
+	logrus.Debug(fmt.Sprintf("Started service '%s' with process group %d", s.command.Name, cmd.Process.Pid))
+	go func() {
+		s.waitErr = cmd.Wait()
+		close(s.exited)
+	}()
+	return nil
+}
+
+// waitReady polls the readiness probes until all of them succeed, the service exits or the probe times out.
+func (s *service) waitReady(ctx context.Context, probe readinessProbe) error {
+	deadline := time.NewTimer(probe.timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(readyInterval)
+	defer ticker.Stop()
+
+	for {
+		failed := s.check(ctx, probe)
+		if failed == "" {
+			return nil
+		}
+		select {
+		case <-s.exited:
+			return fmt.Errorf("%w: service '%s' exited before it was ready: %v", ErrServiceNotReady, s.command.Name, exitDescription(s.waitErr))
+		case <-deadline.C:
+			return fmt.Errorf("%w: service '%s' is not ready after %v: %s", ErrServiceNotReady, s.command.Name, probe.timeout, failed)
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// check runs the readiness probes once and describes the first one which failed, or returns "" if all succeeded.
+func (s *service) check(ctx context.Context, probe readinessProbe) string {
+	if probe.address != "" {
+		conn, err := net.DialTimeout("tcp", probe.address, probeTimeout)
+		if err != nil {
+			return fmt.Sprintf("no connection to %s", probe.address)
+		}
+		conn.Close()
+	}
+	if probe.url != "" {
+		client := http.Client{Timeout: probeTimeout}
+		resp, err := client.Get(probe.url)
+		if err != nil {
+			return fmt.Sprintf("GET %s failed", probe.url)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Sprintf("GET %s returned %s", probe.url, resp.Status)
+		}
+	}
+	if probe.log != nil && !s.logged.Load() {
+		return fmt.Sprintf("no output line matched '%s'", probe.log)
+	}
+	if probe.command != "" {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(probeCtx, "sh", "-c", probe.command)
+		cmd.Dir = s.cmd.Dir
+		cmd.Env = s.cmd.Env
+		if err := cmd.Run(); err != nil {
+			return fmt.Sprintf("'%s' failed: %v", probe.command, err)
+		}
+	}
+	return ""
+}
+
+// exitDescription describes how a process exited for an error returned by cmd.Wait.
+func exitDescription(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+/*
+stop stops the service unless it already exited. If cause is a *signalError, its signal is forwarded,
+otherwise stopSignal is sent.
+*/
+func (s *service) stop(cause error) error {
+	defer os.Remove(s.script)
+	select {
+	case <-s.exited:
+		if s.err != nil {
+			return s.err
+		}
+		// a service which exits on its own before the end of the invocation failed
+		logrus.Warn(fmt.Sprintf("Service '%s' exited before the end of the invocation: %v", s.command.Name, exitDescription(s.waitErr)))
+		if s.waitErr == nil {
+			return fmt.Errorf("%w: service '%s' exited before the end of the invocation", ErrExecutionFailed, s.command.Name)
+		}
+		return s.waitErr
+	default:
+	}
+
+	logrus.Debug(fmt.Sprintf("Stopping service '%s'", s.command.Name))
+	stopProcess(s.cmd, s.exited, cause)
+	return s.err
+}
+
+// finish records the result of the service, which returned err.
+func (s *service) finish(state *runState, err error) {
+	s.flushLog()
+	result := blockResult{
+		command:   s.command,
+		codeBlock: s.codeBlock,
+		start:     s.start,
+		duration:  time.Since(s.start),
+		exitCode:  exitCode(err),
+		err:       err,
+	}
+	s.recorded.fill(&result)
+	state.addResult(result)
+	state.emit(blockFinishedEvent(s.command, s.codeBlock, result.duration, err))
+}
+
+// addService registers a started service, so it is stopped at the end of the invocation.
+func (s *runState) addService(svc *service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services = append(s.services, svc)
+}
+
+/*
+stopServices stops all services started in this invocation, in reverse order of their start, and records
+their results. cause is the reason the services are stopped, see stopProcess. The returned error contains
+the errors of the services which exited on their own before the end of the invocation. Services which did
+not become ready already failed the command which started them.
+*/
+func (s *runState) stopServices(cause error) error {
+	s.mu.Lock()
+	services := s.services
+	s.services = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for i := len(services) - 1; i >= 0; i-- {
+		svc := services[i]
+		err := svc.stop(cause)
+		svc.finish(s, err)
+		if err != nil && svc.err == nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lineMatcher sets the logged flag of a service once a line of the output matches its ready_log pattern.
+type lineMatcher struct {
+	mu      sync.Mutex
+	service *service
+	pattern *regexp.Regexp
+	partial []byte
+}
+
+func (m *lineMatcher) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.service.logged.Load() {
+		return len(p), nil
+	}
+	m.partial = append(m.partial, p...)
+	for {
+		i := bytes.IndexByte(m.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := m.partial[:i]
+		m.partial = m.partial[i+1:]
+		if m.pattern.Match(line) {
+			m.service.logged.Store(true)
+			m.partial = nil
+			return len(p), nil
+		}
+	}
+	// the line the service is waiting on, like a prompt, is not necessarily terminated
+	if m.pattern.Match(m.partial) {
+		m.service.logged.Store(true)
+		m.partial = nil
+	}
+	return len(p), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetReadinessProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    map[string]any
+		want    readinessProbe
+		wantErr error
+	}{
+		{"Default", map[string]any{}, readinessProbe{timeout: defaultReadyTimeout}, nil},
+		{"Port", map[string]any{"ready_port": "5432"}, readinessProbe{address: "localhost:5432", timeout: defaultReadyTimeout}, nil},
+		{"Address", map[string]any{"ready_port": "127.0.0.1:5432"}, readinessProbe{address: "127.0.0.1:5432", timeout: defaultReadyTimeout}, nil},
+		{"URL", map[string]any{"ready_url": "localhost:8080/health"}, readinessProbe{url: "http://localhost:8080/health", timeout: defaultReadyTimeout}, nil},
+		{"Command", map[string]any{"ready_cmd": "true", "ready_timeout": "5s"}, readinessProbe{command: "true", timeout: 5 * time.Second}, nil},
+		{"InvalidTimeout", map[string]any{"ready_timeout": "soon"}, readinessProbe{}, ErrInvalidAttribute},
+		{"InvalidLog", map[string]any{"ready_log": "("}, readinessProbe{}, ErrInvalidAttribute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := getReadinessProbe(&CommandBlock{Meta: tt.meta}, &CodeBlock{Meta: map[string]any{}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("getReadinessProbe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && probe != tt.want {
+				t.Errorf("getReadinessProbe() = %+v, want %+v", probe, tt.want)
+			}
+		})
+	}
+}
+
+func serviceCommands(serviceMeta map[string]any, serviceCode string) map[string]CommandBlock {
+	return map[string]CommandBlock{
+		"api": {
+			Name: "api",
+			CodeBlocks: []CodeBlock{
+				{Lang: "sh", Code: "echo preparing", Meta: map[string]any{"shebang": false}},
+				{Lang: "sh", Code: serviceCode, Meta: map[string]any{"shebang": false}},
+			},
+			Meta: serviceMeta,
+		},
+		"migrate": {
+			Name:         "migrate",
+			Dependencies: []string{"api"},
+			CodeBlocks:   []CodeBlock{{Lang: "sh", Code: "echo migrated", Meta: map[string]any{"shebang": false}}},
+			Meta:         map[string]any{},
+		},
+		"test": {
+			Name:         "test",
+			Dependencies: []string{"api", "migrate"},
+			CodeBlocks:   []CodeBlock{{Lang: "sh", Code: "cat \"$READY_FILE\"", Meta: map[string]any{"shebang": false}}},
+			Meta:         map[string]any{},
+		},
+	}
+}
+
+func TestExecuteCommandBlock_Service(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	dir := t.TempDir()
+	readyFile := filepath.Join(dir, "ready")
+	pidFile := filepath.Join(dir, "pid")
+	t.Setenv("READY_FILE", readyFile)
+
+	commands := serviceCommands(
+		map[string]any{"service": "true", "ready_log": "^listening$", "ready_timeout": "10s"},
+		"echo $$ > "+pidFile+"; sleep 0.3; echo up > \"$READY_FILE\"; echo listening; exec sleep 60",
+	)
+	handler := &recordedEvents{}
+	var state *runState
+	command := commands["test"]
+	output, err := captureOutput(func() error {
+		state = newRunState()
+		state.events = handler
+		state.recordOutput = true
+		return executeCommandBlock(withRunState(context.Background(), state), commands, &command)
+	})
+	if err != nil {
+		t.Fatalf("executeCommandBlock() error = %v, output %q", err, output)
+	}
+	if !strings.Contains(output, "up") {
+		t.Errorf("output = %q, want the dependent to run after the service became ready", output)
+	}
+
+	started := 0
+	for _, e := range handler.events {
+		if e.Type == eventCommandStarted && e.Command == "api" {
+			started++
+		}
+	}
+	if started != 1 {
+		t.Errorf("service started %d times, want once", started)
+	}
+
+	results := state.getResults()
+	last := results[len(results)-1]
+	if last.command.Name != "api" || last.err != nil || !strings.Contains(string(last.output), "listening") {
+		t.Errorf("last result = %s %v %q, want the stopped service", last.command.Name, last.err, last.output)
+	}
+
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	if processRunning(pid) {
+		t.Errorf("service process %d is still running", pid)
+	}
+}
+
+func TestExecuteCommandBlock_ServicePort(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	t.Setenv("READY_FILE", "/dev/null")
+
+	commands := serviceCommands(map[string]any{"service": "true", "ready_port": "127.0.0.1:" + port}, "exec sleep 60")
+	command := commands["test"]
+	if _, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &command)
+	}); err != nil {
+		t.Errorf("executeCommandBlock() error = %v", err)
+	}
+}
+
+func TestExecuteCommandBlock_ServiceNotReady(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	tests := []struct {
+		name    string
+		meta    map[string]any
+		code    string
+		wantErr error
+	}{
+		{"Exited", map[string]any{"service": "true", "ready_cmd": "false"}, "exit 3", ErrServiceNotReady},
+		{"Timeout", map[string]any{"service": "true", "ready_cmd": "false", "ready_timeout": "300ms"}, "exec sleep 60", ErrServiceNotReady},
+		{"Pipe", map[string]any{"service": "true", "pipe": "true"}, "exec sleep 60", ErrInvalidAttribute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := serviceCommands(tt.meta, tt.code)
+			command := commands["migrate"]
+			start := time.Now()
+			_, err := captureOutput(func() error {
+				return executeCommandBlock(context.Background(), commands, &command)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("executeCommandBlock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("executeCommandBlock() took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestExecuteCommandBlock_ServiceExitedEarly(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := serviceCommands(map[string]any{"service": "true"}, "exit 4")
+	migrate := commands["migrate"]
+	migrate.CodeBlocks = []CodeBlock{{Lang: "sh", Code: "sleep 0.5; echo migrated", Meta: map[string]any{"shebang": false}}}
+	commands["migrate"] = migrate
+
+	_, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &migrate)
+	})
+	if exitCode(err) != 4 {
+		t.Errorf("executeCommandBlock() error = %v, want the exit status 4 of the service", err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+sessionDrivers contain the programs which run in a session interpreter. The driver reads lines with
+the path of a script, the path of the output file and the path of an environment file from fd 3,
+executes the environment file and the script in the same interpreter, writes the marker to stdout
+and stderr and finally the exit status of the script to fd 4.
+*/
+var sessionDrivers = map[string][]string{
+	"sh": {"-c", `
+while IFS="$(printf '\t')" read -r mdx_script MDX_OUTPUT mdx_env <&3; do
+	export MDX_OUTPUT
+	. "$mdx_env"
+	. "$mdx_script"
+	mdx_status=$?
+	printf '%s' "$MDX_SESSION_MARKER"
+	printf '%s' "$MDX_SESSION_MARKER" >&2
+	printf '%d\n' "$mdx_status" >&4
+done
+`},
+	"py": {"-u", "-c", `
+import os, sys, traceback
+_mdx_scripts = os.fdopen(3, "r")
+_mdx_status = os.fdopen(4, "w")
+_mdx_marker = os.environ["MDX_SESSION_MARKER"]
+_mdx_globals = {"__name__": "__main__"}
+for _mdx_line in _mdx_scripts:
+    _mdx_script, os.environ["MDX_OUTPUT"], _mdx_env = _mdx_line.rstrip("\n").split("\t")
+    _mdx_code = 0
+    try:
+        with open(_mdx_env) as _mdx_file:
+            exec(_mdx_file.read(), {"os": os})
+        with open(_mdx_script) as _mdx_file:
+            exec(compile(_mdx_file.read(), _mdx_script, "exec"), _mdx_globals)
+    except SystemExit as e:
+        _mdx_code = e.code if isinstance(e.code, int) else (0 if e.code is None else 1)
+    except BaseException:
+        traceback.print_exc()
+        _mdx_code = 1
+    sys.stdout.flush()
+    sys.stderr.flush()
+    sys.stdout.write(_mdx_marker)
+    sys.stderr.write(_mdx_marker)
+    sys.stdout.flush()
+    sys.stderr.flush()
+    _mdx_status.write("%d\n" % _mdx_code)
+    _mdx_status.flush()
+`},
+}
+
+/*
+sessionExports contain the statements which export an output to the environment of a session
+interpreter. The outputs of earlier code blocks are exported before every code block, since the
+environment of the interpreter is fixed when it is started.
+*/
+var sessionExports = map[string]func(name string, value string) string{
+	"sh": func(name string, value string) string {
+		return fmt.Sprintf("export %s='%s'\n", name, strings.ReplaceAll(value, "'", `'\''`))
+	},
+	"py": func(name string, value string) string {
+		// a JSON string is a valid Python string literal
+		quoted, _ := json.Marshal(value)
+		return fmt.Sprintf("os.environ[%q] = %s\n", name, quoted)
+	},
+}
+
+func init() {
+	sessionDrivers["bash"] = sessionDrivers["sh"]
+	sessionExports["bash"] = sessionExports["sh"]
+}
+
+// supportsSession reports whether codeBlock can be executed in a session interpreter.
+func supportsSession(codeBlock *CodeBlock) bool {
+	_, ok := sessionDrivers[codeBlock.Lang]
+	shebang, _ := codeBlock.Meta["shebang"].(bool)
+	return ok && !shebang
+}
+
+/*
+session is a long-lived interpreter process, which executes consecutive code blocks of the same language
+of a command, like a notebook kernel. Variables, the current directory and imports are preserved between
+the code blocks.
+*/
+type session struct {
+	lang            string
+	cmd             *exec.Cmd
+	scripts         *os.File // write end of the pipe the driver reads scripts from
+	status          chan int // exit status of the executed scripts
+	stdout          *sessionStream
+	stderr          *sessionStream
+	exited          chan struct{} // closed when the interpreter exited
+	waitErr         error
+	restoreTerminal func()
+}
+
+// startSession starts the interpreter for the language of codeBlock.
+func startSession(ctx context.Context, commandBlock *CommandBlock, codeBlock *CodeBlock) (*session, error) {
+	launcher, ok := launchers[codeBlock.Lang]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoLauncherDefined, codeBlock.Lang)
+	}
+	dir, err := workingDirectory(commandBlock, codeBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	marker := "\x1emdx-session-" + hex.EncodeToString(token) + "\x1e"
+
+	scriptsReader, scriptsWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	statusReader, statusWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	state := getRunState(ctx)
+	s := &session{
+		lang:    codeBlock.Lang,
+		cmd:     exec.Command(launcher.cmd, sessionDrivers[codeBlock.Lang]...),
+		scripts: scriptsWriter,
+		// buffered, the interpreter might finish a code block after it was cancelled
+		status: make(chan int, 1),
+		stdout: &sessionStream{fallback: state.stdout, marker: []byte(marker), end: make(chan struct{}, 1)},
+		stderr: &sessionStream{fallback: state.stderr, marker: []byte(marker), end: make(chan struct{}, 1)},
+		exited: make(chan struct{}),
+	}
+	s.cmd.Dir = dir
+	s.cmd.Env = codeBlockEnv(ctx, s.cmd, "MDX_SESSION_MARKER="+marker)
+	s.cmd.Stdin = os.Stdin
+	s.cmd.ExtraFiles = []*os.File{scriptsReader, statusWriter}
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := s.cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	s.restoreTerminal = setProcessGroup(s.cmd)
+	logrus.Debug(fmt.Sprintf("Starting '%s' session for command '%s' in directory: %s", s.lang, commandBlock.Name, dir))
+	err = s.cmd.Start()
+	scriptsReader.Close()
+	statusWriter.Close()
+	if err != nil {
+		scriptsWriter.Close()
+		statusReader.Close()
+		s.restoreTerminal()
+		return nil, err
+	}
+
+	var streams sync.WaitGroup
+	streams.Add(2)
+	go func() { defer streams.Done(); s.stdout.copy(stdout) }()
+	go func() { defer streams.Done(); s.stderr.copy(stderr) }()
+	go func() {
+		scanner := bufio.NewScanner(statusReader)
+		for scanner.Scan() {
+			status, _ := strconv.Atoi(scanner.Text())
+			s.status <- status
+		}
+		statusReader.Close()
+	}()
+	go func() {
+		// the pipes have to be read completely before calling Wait
+		streams.Wait()
+		s.waitErr = s.cmd.Wait()
+		close(s.exited)
+	}()
+
+	return s, nil
+}
+
+/*
+run executes the rendered code of a code block in the session. The output of the code block is
+written to stdout and stderr, outputFile is passed as $MDX_OUTPUT. The outputs of the code blocks
+executed so far are exported before the code is executed.
+*/
+func (s *session) run(ctx context.Context, code string, outputFile string, stdout io.Writer, stderr io.Writer) error {
+	var exports strings.Builder
+	for _, variable := range getRunState(ctx).outputEnv() {
+		name, value, _ := strings.Cut(variable, "=")
+		exports.WriteString(sessionExports[s.lang](name, value))
+	}
+	envFile, err := writeSessionFile("mdx-session-env-*", exports.String())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(envFile)
+	script, err := writeSessionFile("mdx-session-*", code)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(script)
+
+	s.stdout.setWriter(stdout)
+	s.stderr.setWriter(stderr)
+	if _, err := fmt.Fprintf(s.scripts, "%s\t%s\t%s\n", script, outputFile, envFile); err != nil {
+		return fmt.Errorf("%w: session has ended: %v", ErrExecutionFailed, err)
+	}
+
+	select {
+	case status := <-s.status:
+		// the output of the code block is complete once the markers were read
+		<-s.stdout.end
+		<-s.stderr.end
+		if status != 0 {
+			return fmt.Errorf("%w: %w", ErrExecutionFailed, &exitStatusError{status: status})
+		}
+		return nil
+	case <-s.exited:
+		// the code block called exit, later code blocks can not be executed in the session
+		if s.waitErr == nil {
+			return fmt.Errorf("%w: the code block called exit and ended the '%s' session", ErrExecutionFailed, s.lang)
+		}
+		if sig, ok := interruptSignal(s.waitErr); ok {
+			return &signalError{sig: sig}
+		}
+		return fmt.Errorf("%w: %w", ErrExecutionFailed, s.waitErr)
+	case <-ctx.Done():
+		cause := context.Cause(ctx)
+		stopProcess(s.cmd, s.exited, cause)
+		return cause
+	}
+}
+
+// writeSessionFile writes content to a new temporary file and returns its path.
+func writeSessionFile(pattern string, content string) (string, error) {
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write to temporary file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to close temporary file: %v", err)
+	}
+	return file.Name(), nil
+}
+
+// close ends the session and waits for the interpreter to exit.
+func (s *session) close() {
+	defer s.restoreTerminal()
+	s.scripts.Close()
+
+	select {
+	case <-s.exited:
+	case <-time.After(settings.GracePeriod):
+		stopProcess(s.cmd, s.exited, nil)
+	}
+	logrus.Debug(fmt.Sprintf("Closed '%s' session: %v", s.lang, s.waitErr))
+}
+
+/*
+sessionStream forwards the output of a session interpreter to the writer of the running code block.
+The driver writes a marker after every code block, which ends the output of the code block.
+*/
+type sessionStream struct {
+	mu       sync.Mutex
+	writer   io.Writer
+	fallback io.Writer // receives output written between code blocks, e.g. by background processes
+	marker   []byte
+	end      chan struct{} // receives a value for every marker, closed at the end of the stream
+}
+
+func (s *sessionStream) setWriter(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writer = w
+}
+
+func (s *sessionStream) write(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer != nil && len(p) > 0 {
+		s.writer.Write(p)
+	}
+}
+
+func (s *sessionStream) copy(r io.Reader) {
+	defer close(s.end)
+
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		pending = append(pending, buf[:n]...)
+
+		for {
+			i := bytes.Index(pending, s.marker)
+			if i < 0 {
+				break
+			}
+			s.write(pending[:i])
+			pending = pending[i+len(s.marker):]
+			s.setWriter(s.fallback)
+			s.end <- struct{}{}
+		}
+
+		// hold back the beginning of a marker, which is completed by the next read
+		keep := 0
+		for k := min(len(pending), len(s.marker)-1); k > 0; k-- {
+			if bytes.HasSuffix(pending, s.marker[:k]) {
+				keep = k
+				break
+			}
+		}
+		s.write(pending[:len(pending)-keep])
+		pending = pending[len(pending)-keep:]
+
+		if err != nil {
+			s.write(pending)
+			return
+		}
+	}
+}
+
+/*
+executeSessionBlock executes codeBlock in the session s. The output handling is the same as for
+code blocks executed in their own process, but retries are not supported: the state of the session
+might already be changed by the failed attempt.
+*/
+func executeSessionBlock(ctx context.Context, s *session, commandBlock *CommandBlock, codeBlock *CodeBlock, args ...string) (err error) {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	state := getRunState(ctx)
+	start := time.Now()
+	state.emit(blockEvent(eventBlockStarted, commandBlock, codeBlock))
+	var recorded *recorder
+	defer func() {
+		result := blockResult{
+			command:   commandBlock,
+			codeBlock: codeBlock,
+			start:     start,
+			duration:  time.Since(start),
+			exitCode:  exitCode(err),
+			err:       err,
+		}
+		recorded.fill(&result)
+		state.addResult(result)
+		state.emit(blockFinishedEvent(commandBlock, codeBlock, result.duration, err))
+	}()
+	if _, ok := blockAttribute(commandBlock, codeBlock, "retries"); ok {
+		logrus.Warn(fmt.Sprintf("Retries are not supported in sessions, executing code block '%s' of command '%s' once", codeBlock.Lang, commandBlock.Name))
+	}
+
+	capture, _ := metaString(codeBlock.Meta, "capture")
+	if capture != "" && !outputNamePattern.MatchString(capture) {
+		return fmt.Errorf("%w: capture=%s: expected a valid variable name", ErrInvalidAttribute, capture)
+	}
+
+	timeout, _, err := metaDuration(codeBlock.Meta, "timeout")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, timeout, fmt.Sprintf("code block '%s'", codeBlock.Lang))
+	defer cancel()
+
+	code, err := renderCodeBlock(ctx, commandBlock, codeBlock, args...)
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := os.CreateTemp("", "mdx-output-*")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	outputFile.Close()
+	defer os.Remove(outputFile.Name())
+
+	stdout := state.stdout
+	stderr := state.stderr
+	var captured bytes.Buffer
+	if capture != "" {
+		stdout = &captured
+	}
+	if state.recordOutput {
+		recorded = &recorder{}
+		stdout, stderr = recorded.tee(stdout, stderr)
+	}
+	stdout, stderr = state.teeEvents(commandBlock, codeBlock, stdout, stderr)
+	stdout, stderr, flushLog := state.teeLog(commandBlock, stdout, stderr)
+	defer flushLog()
+
+	traceCodeBlock(commandBlock, codeBlock, code, s.cmd.Env)
+	if err := s.run(ctx, code, outputFile.Name(), stdout, stderr); err != nil {
+		return err
+	}
+
+	outputs, err := readOutputFile(outputFile.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read outputs of command '%s': %w", commandBlock.Name, err)
+	}
+	if capture != "" {
+		outputs[capture] = strings.TrimSpace(captured.String())
+	}
+	if len(outputs) > 0 {
+		logrus.Debug(fmt.Sprintf("Outputs of command '%s': %v", commandBlock.Name, outputs))
+		state.setOutputs(commandBlock.Name, outputs)
+	}
+	return nil
+}
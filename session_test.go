@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestExecuteCommandBlock_Session(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	commands := make(map[string]CommandBlock)
+
+	commands["test"] = CommandBlock{
+		Name: "test",
+		CodeBlocks: []CodeBlock{
+			{
+				Lang: "sh",
+				Code: "cd /\nGREETING=Hello\nexport NAME={{.arg1}}",
+				Meta: map[string]interface{}{"shebang": false},
+			},
+			{
+				Lang: "sh",
+				Code: `echo -n "$GREETING $NAME from $(pwd)"`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+		},
+		Dependencies: []string{},
+		Meta:         map[string]interface{}{"session": "true"},
+	}
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock, "World")
+	})
+
+	if err != nil {
+		t.Errorf("executeCommandBlock() error = %v", err)
+	}
+	expectedOutput := "Hello World from /"
+	if output != expectedOutput {
+		t.Errorf("executeCommandBlock() output = %v, expectedOutput %v", output, expectedOutput)
+	}
+}
+
+func TestExecuteCommandBlock_SessionFailure(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}, "bash": {"sh", "sh"}}
+	commands := make(map[string]CommandBlock)
+
+	commands["test"] = CommandBlock{
+		Name: "test",
+		CodeBlocks: []CodeBlock{
+			{
+				Lang: "sh",
+				Code: `echo -n "first"; false`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+			{
+				Lang: "sh",
+				Code: `echo -n "not reached"`,
+				Meta: map[string]interface{}{"shebang": false},
+			},
+		},
+		Dependencies: []string{},
+		Meta:         map[string]interface{}{"session": "true"},
+	}
+	wantErr := ErrExecutionFailed
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock)
+	})
+
+	if !errors.Is(err, wantErr) {
+		t.Errorf("executeCommandBlock() error = %v, wantErr %v", err, wantErr)
+	}
+	if output != "first" {
+		t.Errorf("executeCommandBlock() output = %v, expectedOutput %v", output, "first")
+	}
+}
+
+func TestSessionStream(t *testing.T) {
+	marker := "\x1emarker\x1e"
+
+	var first, second, between bytes.Buffer
+	stream := &sessionStream{fallback: &between, marker: []byte(marker), end: make(chan struct{}, 1)}
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		// read one byte at a time to split the markers
+		stream.copy(iotest.OneByteReader(r))
+		close(done)
+	}()
+
+	stream.setWriter(&first)
+	io.WriteString(w, "first"+marker)
+	<-stream.end
+	stream.setWriter(&second)
+	io.WriteString(w, "second\n"+marker)
+	<-stream.end
+	io.WriteString(w, "between")
+	w.Close()
+	<-done
+
+	if first.String() != "first" || second.String() != "second\n" || between.String() != "between" {
+		t.Errorf("sessionStream.copy() = %q, %q, %q; want %q, %q, %q", first.String(), second.String(), between.String(), "first", "second\n", "between")
+	}
+}
+
+func TestExecuteCommandBlock_SessionExit(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"test": {
+			Name: "test",
+			CodeBlocks: []CodeBlock{
+				{Lang: "sh", Code: `echo -n "first"; exit 0`, Meta: map[string]any{"shebang": false}},
+				{Lang: "sh", Code: `echo -n "not reached"`, Meta: map[string]any{"shebang": false}},
+			},
+			Meta: map[string]any{"session": "true"},
+		},
+	}
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock)
+	})
+	if !errors.Is(err, ErrExecutionFailed) || !strings.Contains(err.Error(), "ended the 'sh' session") {
+		t.Errorf("executeCommandBlock() error = %v, want the session to be reported as ended", err)
+	}
+	if output != "first" {
+		t.Errorf("executeCommandBlock() output = %v, expectedOutput %v", output, "first")
+	}
+}
+
+func TestExecuteCommandBlock_SessionOutputs(t *testing.T) {
+	launchers = map[string]LauncherBlock{"sh": {"sh", "sh"}}
+	commands := map[string]CommandBlock{
+		"test": {
+			Name: "test",
+			CodeBlocks: []CodeBlock{
+				{Lang: "sh", Code: `echo "it's 1.0"`, Meta: map[string]any{"shebang": false, "capture": "VERSION"}},
+				{Lang: "sh", Code: `echo "BUILD=42" >> "$MDX_OUTPUT"`, Meta: map[string]any{"shebang": false}},
+				{Lang: "sh", Code: `echo -n "$VERSION $BUILD"`, Meta: map[string]any{"shebang": false}},
+			},
+			Meta: map[string]any{"session": "true"},
+		},
+	}
+
+	commandBlock := commands["test"]
+	output, err := captureOutput(func() error {
+		return executeCommandBlock(context.Background(), commands, &commandBlock)
+	})
+	if err != nil {
+		t.Errorf("executeCommandBlock() error = %v", err)
+	}
+	if want := "it's 1.0 42"; output != want {
+		t.Errorf("executeCommandBlock() output = %q, expectedOutput %q", output, want)
+	}
+}
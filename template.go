@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// reservedNames are the fields of the template data which can not be used as names of parameters.
+var reservedNames = []string{"args", "params", "environ", "command", "file", "os", "arch", "git", "timestamp", "outputs"}
+
+/*
+templateData returns the data available in the templates of the code blocks of commandBlock, in its conditions
+and in the arguments it passes to its dependencies. fields are the fields used by the template, see templateFields,
+so expensive fields are only determined if they are used.
+
+	.arg1, .arg2, ...  the arguments of the command
+	.<param>           the argument at the position of the parameter, see commandParams
+	.args              all arguments of the command
+	.params            the arguments by parameter name
+	.environ           the environment variables of mdx, env is left for a parameter
+	.command           the name of the command
+	.file              the markdown file of the command
+	.os, .arch         the platform mdx runs on, like linux and amd64
+	.git.branch        the current git branch of the markdown file, "" outside of a git repository
+	.git.commit        the current git commit of the markdown file, "" outside of a git repository
+	.timestamp         the current time in RFC 3339 format
+	.outputs           the outputs of the executed commands, see setOutputs
+*/
+func templateData(ctx context.Context, commandBlock *CommandBlock, args []string, fields map[string]bool) map[string]any {
+	data := argumentData(commandBlock, args)
+
+	params := make(map[string]string)
+	for i, param := range commandParams(commandBlock) {
+		if i < len(args) {
+			params[param] = args[i]
+		}
+	}
+	env := make(map[string]string)
+	for _, variable := range os.Environ() {
+		if name, value, ok := strings.Cut(variable, "="); ok {
+			env[name] = value
+		}
+	}
+
+	data["args"] = append([]string{}, args...)
+	data["params"] = params
+	data["environ"] = env
+	data["command"] = commandBlock.Name
+	data["file"] = commandBlock.Filename
+	data["os"] = runtime.GOOS
+	data["arch"] = runtime.GOARCH
+	data["timestamp"] = time.Now().Format(time.RFC3339)
+	data["outputs"] = getRunState(ctx).outputsSnapshot()
+	if fields["git"] {
+		data["git"] = gitInfo(ctx, commandBlock)
+	}
+	return data
+}
+
+// gitInfo returns the current branch and commit of the git repository containing the markdown file of commandBlock.
+func gitInfo(ctx context.Context, commandBlock *CommandBlock) map[string]string {
+	dir := "."
+	if commandBlock.Filename != "" {
+		dir = filepath.Dir(commandBlock.Filename)
+	}
+	git := func(args ...string) string {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(output))
+	}
+	return map[string]string{
+		"branch": git("rev-parse", "--abbrev-ref", "HEAD"),
+		"commit": git("rev-parse", "HEAD"),
+	}
+}
+
+// isEmpty reports whether value is the zero value of its type, or an empty string, slice or map.
+func isEmpty(value any) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+/*
+templateFuncs returns the functions available in all templates, in addition to the functions of Go templates.
+The names follow the sprig library. Relative paths are resolved in dir.
+
+	default "x" .value           .value, or "x" if .value is empty
+	required "message" .value    .value, or fails with message if .value is empty
+	upper, lower, trim           change the case of a string or remove leading and trailing whitespace
+	quote, squote                enclose a string in double quotes, with Go escaping, or in single quotes
+	toJson .value                encode a value as JSON
+	b64enc, b64dec               encode or decode a string with standard base64
+	sha256sum                    the hex encoded SHA-256 hash of a string
+	readFile "path"              the content of a file
+	joinPath "a" "b"             join path elements with the separator of the platform
+	regexReplaceAll "re" .s "r"  replace all matches of the regular expression in .s, with $1 for submatches
+	env "NAME"                   the value of an environment variable, "" if it is not set
+	secret "db/password"         a secret of a provider, see secretStore, which is masked in the messages of mdx
+*/
+func templateFuncs(ctx context.Context, dir string) template.FuncMap {
+	return template.FuncMap{
+		"default": func(def any, value any) any {
+			if isEmpty(value) {
+				return def
+			}
+			return value
+		},
+		"required": func(message string, value any) (any, error) {
+			if isEmpty(value) {
+				return nil, errors.New(message)
+			}
+			return value, nil
+		},
+		"upper":  strings.ToUpper,
+		"lower":  strings.ToLower,
+		"trim":   strings.TrimSpace,
+		"quote":  func(s string) string { return strconv.Quote(s) },
+		"squote": func(s string) string { return "'" + s + "'" },
+		"toJson": func(value any) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			decoded, err := base64.StdEncoding.DecodeString(s)
+			return string(decoded), err
+		},
+		"sha256sum": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"readFile": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			content, err := os.ReadFile(path)
+			return string(content), err
+		},
+		"joinPath": filepath.Join,
+		"regexReplaceAll": func(pattern string, s string, replacement string) (string, error) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return "", err
+			}
+			return re.ReplaceAllString(s, replacement), nil
+		},
+		"env": os.Getenv,
+		"secret": func(ref string) (string, error) {
+			return secrets.resolve(ctx, dir, ref)
+		},
+	}
+}
+
+/*
+codeTemplate returns the delimiters of the template of codeBlock, which are {{ and }} unless the delims attribute
+of the code block, its command or its file sets others, like delims="[[ ]]". enabled is false if the template
+attribute turns templating off, like template=off, then the code is executed as written.
+*/
+func codeTemplate(commandBlock *CommandBlock, codeBlock *CodeBlock) (left, right string, enabled bool, err error) {
+	if value, ok := blockAttribute(commandBlock, codeBlock, "template"); ok {
+		switch value {
+		case "off", "false":
+			return "", "", false, nil
+		case "on", "true":
+		default:
+			return "", "", false, fmt.Errorf("%w: template=%s: expected on or off", ErrInvalidAttribute, value)
+		}
+	}
+	left, right = "{{", "}}"
+	if value, ok := blockAttribute(commandBlock, codeBlock, "delims"); ok {
+		delims := strings.Fields(value)
+		if len(delims) != 2 {
+			return "", "", false, fmt.Errorf("%w: delims=%s: expected the left and the right delimiter, like \"[[ ]]\"", ErrInvalidAttribute, value)
+		}
+		left, right = delims[0], delims[1]
+	}
+	return left, right, true, nil
+}
+
+// templateLocation matches the location in the errors of text/template, like "template: build:3:12: ".
+var templateLocation = regexp.MustCompile(`^template: [^:]*:(\d+)(?::\d+)?: `)
+
+/*
+templateError describes an error of the template of codeBlock with its line in the markdown file,
+like "README.md:14: executing ... map has no entry for key "version"".
+*/
+func templateError(commandBlock *CommandBlock, codeBlock *CodeBlock, err error) error {
+	message := err.Error()
+	line := codeBlock.Line
+	if match := templateLocation.FindStringSubmatch(message); match != nil {
+		offset, _ := strconv.Atoi(match[1])
+		line += offset
+		message = message[len(match[0]):]
+	}
+	return fmt.Errorf("%w: %s:%d: %s", ErrInvalidTemplate, commandBlock.Filename, line, message)
+}
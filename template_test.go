@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRenderCodeBlock_Templates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.2.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MDX_TEST_TOKEN", "secret")
+	t.Setenv("MDX_TEST_EMPTY", "")
+
+	tests := []struct {
+		name    string
+		code    string
+		args    []string
+		want    string
+		wantErr error
+	}{
+		{"Args", "{{.args}} {{.arg2}} {{.target}} {{.params.version}}", []string{"linux", "1.0"}, "[linux 1.0] 1.0 linux 1.0", nil},
+		{"Context", "{{.command}} {{.file}} {{.os}}/{{.arch}}", []string{"a", "b"}, "build " + filepath.Join(dir, "runbook.md") + " " + runtime.GOOS + "/" + runtime.GOARCH, nil},
+		{"Env", "{{.environ.MDX_TEST_TOKEN}} {{env \"MDX_TEST_TOKEN\"}}", nil, "secret secret", nil},
+		{"Default", "{{.environ.MDX_TEST_EMPTY | default \"dev\"}} {{.arg1 | default \"dev\"}}", []string{"prod", "x"}, "dev prod", nil},
+		{"Required", "{{required \"MDX_TEST_EMPTY is not set\" .environ.MDX_TEST_EMPTY}}", nil, "", ErrInvalidTemplate},
+		{"Strings", "{{upper \"a\"}}{{lower \"B\"}} {{quote \"a b\"}} {{squote \"c\"}} {{trim \" d \"}}", nil, "Ab \"a b\" 'c' d", nil},
+		{"Encoding", "{{toJson .args}} {{b64enc \"mdx\"}} {{b64dec \"bWR4\"}}", []string{"a", "b"}, "[\"a\",\"b\"] bWR4 mdx", nil},
+		{"Hash", "{{sha256sum \"mdx\"}}", nil, "c49d77a46e023fd57d713dfe5bd0cd532be9ba6a61d43e115230891527dddf78", nil},
+		{"Files", "{{readFile \"VERSION\" | trim}} {{joinPath \"a\" \"b\"}}", nil, "1.2.0 a/b", nil},
+		{"MissingFile", "{{readFile \"MISSING\"}}", nil, "", ErrInvalidTemplate},
+		{"RegexReplace", "{{regexReplaceAll \"v([0-9]+)\" \"v1-v2\" \"${1}x\"}}", nil, "1x-2x", nil},
+		{"MissingKey", "{{.missing}}", nil, "", ErrInvalidTemplate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := &CommandBlock{
+				Name:     "build",
+				Filename: filepath.Join(dir, "runbook.md"),
+				Meta:     map[string]any{"params": "target version"},
+			}
+			codeBlock := &CodeBlock{Lang: "sh", Code: tt.code, Meta: map[string]any{"dir": dir}}
+			got, err := renderCodeBlock(context.Background(), command, codeBlock, tt.args...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("renderCodeBlock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderCodeBlock() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCodeBlock_Git(t *testing.T) {
+	command := &CommandBlock{Name: "build", Filename: "README.md", Meta: map[string]any{}}
+	codeBlock := &CodeBlock{Lang: "sh", Code: "{{.git.branch}}", Meta: map[string]any{}}
+	if _, err := renderCodeBlock(context.Background(), command, codeBlock); err != nil {
+		t.Errorf("renderCodeBlock() error = %v", err)
+	}
+
+	// the git information is only determined if a template uses it
+	if data := templateData(context.Background(), command, nil, map[string]bool{}); data["git"] != nil {
+		t.Errorf("templateData() git = %v, want nil", data["git"])
+	}
+}
+
+func TestTemplateError(t *testing.T) {
+	command := &CommandBlock{Name: "build", Filename: "runbook.md", Meta: map[string]any{}}
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"Parse", "echo a\necho {{.arg1", "runbook.md:12: "},
+		{"Execute", "echo a\necho b\necho {{.missing}}", "runbook.md:13: executing"},
+		{"Function", "{{required \"VERSION is required\" \"\"}}", "runbook.md:11: executing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codeBlock := &CodeBlock{Lang: "sh", Code: tt.code, Line: 10, Meta: map[string]any{}}
+			_, err := renderCodeBlock(context.Background(), command, codeBlock)
+			if !errors.Is(err, ErrInvalidTemplate) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("renderCodeBlock() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCodeBlock_Delims(t *testing.T) {
+	tests := []struct {
+		name        string
+		commandMeta map[string]any
+		blockMeta   map[string]any
+		code        string
+		want        string
+		wantErr     error
+	}{
+		{"Default", map[string]any{}, map[string]any{}, "echo {{.arg1}}", "echo a", nil},
+		{"Off", map[string]any{}, map[string]any{"template": "off"}, "echo ${{ github.sha }} {{ .arg1", "echo ${{ github.sha }} {{ .arg1", nil},
+		{"OffForCommand", map[string]any{"template": "off"}, map[string]any{}, "{{ .Values.tag }}", "{{ .Values.tag }}", nil},
+		{"OnForBlock", map[string]any{"template": "off"}, map[string]any{"template": "on"}, "echo {{.arg1}}", "echo a", nil},
+		{"Delims", map[string]any{}, map[string]any{"delims": "[[ ]]"}, "echo [[ .arg1 | upper ]] {{ .Values.tag }}", "echo A {{ .Values.tag }}", nil},
+		{"DelimsForCommand", map[string]any{"delims": "<% %>"}, map[string]any{}, "echo <%.arg1%>", "echo a", nil},
+		{"InvalidDelims", map[string]any{}, map[string]any{"delims": "[["}, "echo", "", ErrInvalidAttribute},
+		{"InvalidTemplate", map[string]any{}, map[string]any{"template": "maybe"}, "echo", "", ErrInvalidAttribute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := &CommandBlock{Name: "build", Meta: tt.commandMeta}
+			codeBlock := &CodeBlock{Lang: "sh", Code: tt.code, Meta: tt.blockMeta}
+			got, err := renderCodeBlock(context.Background(), command, codeBlock, "a")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("renderCodeBlock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderCodeBlock() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateArgUsage_Delims(t *testing.T) {
+	command := &CommandBlock{
+		Name: "install",
+		CodeBlocks: []CodeBlock{
+			{Lang: "sh", Code: "helm install --set tag=[[.arg1]]", Meta: map[string]any{"delims": "[[ ]]"}},
+			{Lang: "sh", Code: "echo {{.arg2}}", Meta: map[string]any{"template": "off"}},
+		},
+		Meta: map[string]any{},
+	}
+	if err := validateArgUsage(command, []string{"1.0"}); err != nil {
+		t.Errorf("validateArgUsage() error = %v", err)
+	}
+	if err := validateArgUsage(command, []string{"1.0", "x"}); !errors.Is(err, ErrArgProvidedButNotUsed) {
+		t.Errorf("validateArgUsage() error = %v, want %v", err, ErrArgProvidedButNotUsed)
+	}
+}
+
+func TestValidateArgUsage_ArgsAndParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		params  string
+		args    []string
+		wantErr error
+	}{
+		{name: "IndexArgs", code: "echo {{index .args 0}}", args: []string{"a", "b"}},
+		{name: "RangeArgs", code: "{{range .args}}echo {{.}}\n{{end}}", args: []string{"a", "b"}},
+		{name: "RootArgs", code: "{{range $.args}}echo {{.}}\n{{end}}", args: []string{"a"}},
+		{name: "ParamsField", code: "echo {{.params.name}}", params: "name", args: []string{"a"}},
+		{name: "ArgN", code: "echo {{.arg1}}", args: []string{"a", "b"}, wantErr: ErrArgProvidedButNotUsed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command := &CommandBlock{
+				Name:       "greet",
+				CodeBlocks: []CodeBlock{{Lang: "sh", Code: tt.code, Meta: map[string]any{}}},
+				Meta:       map[string]any{"params": tt.params},
+			}
+			if err := validateArgUsage(command, tt.args); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateArgUsage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+commandDurations returns the duration of every executed command by name, without its dependencies.
+A command executed more than once, e.g. as dependency of two commands, counts with its longest execution.
+*/
+func commandDurations(results []commandResult) map[string]time.Duration {
+	durations := make(map[string]time.Duration)
+	for _, result := range results {
+		if result.duration > durations[result.command.Name] {
+			durations[result.command.Name] = result.duration
+		}
+	}
+	return durations
+}
+
+/*
+criticalPath returns the longest chain of executed commands through the dependency graph ending in
+name, and its duration. It is the lower bound of the duration of name, even if dependencies could
+run in parallel. Commands which were not executed do not count.
+*/
+func criticalPath(commands map[string]CommandBlock, durations map[string]time.Duration, name string) ([]string, time.Duration) {
+	type path struct {
+		names    []string
+		duration time.Duration
+	}
+	memo := make(map[string]path)
+	visiting := make(map[string]bool)
+
+	var longest func(name string) path
+	longest = func(name string) path {
+		if p, ok := memo[name]; ok {
+			return p
+		}
+		if visiting[name] {
+			return path{}
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		var best path
+		for _, dep := range commands[name].Dependencies {
+			if p := longest(dep); p.duration > best.duration || best.names == nil {
+				best = p
+			}
+		}
+		p := path{names: append(append([]string{}, best.names...), name), duration: best.duration}
+		if duration, ok := durations[name]; ok {
+			p.duration += duration
+		} else {
+			p.names = best.names
+		}
+		memo[name] = p
+		return p
+	}
+
+	p := longest(name)
+	return p.names, p.duration
+}
+
+// share returns part as percentage of total.
+func share(part time.Duration, total time.Duration) string {
+	if total <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(part)/float64(total)*100)
+}
+
+/*
+printTimings prints the duration of every executed command and code block to w, followed by the
+critical path through the dependency graph of command. The total time is the wall-clock time of the
+invocation, the serial time the sum of the durations of all executed commands.
+*/
+func printTimings(w io.Writer, commands map[string]CommandBlock, command *CommandBlock, state *runState, total time.Duration) {
+	blocks := make(map[*CommandBlock][]blockResult)
+	for _, result := range state.getResults() {
+		blocks[result.command] = append(blocks[result.command], result)
+	}
+
+	var serial time.Duration
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Timings:")
+	fmt.Fprintln(tw, "COMMAND\tDURATION\tSHARE")
+	results := state.getCommandResults()
+	for _, result := range results {
+		serial += result.duration
+		status := ""
+		if result.err != nil {
+			status = " (failed)"
+		}
+		fmt.Fprintf(tw, "%s%s\t%v\t%s\n", result.command.Name, status, result.duration.Round(time.Millisecond), share(result.duration, total))
+		for _, block := range blocks[result.command] {
+			fmt.Fprintf(tw, "  %s:%d\t%v\t%s\n", block.codeBlock.Lang, block.codeBlock.Line, block.duration.Round(time.Millisecond), share(block.duration, total))
+		}
+	}
+	tw.Flush()
+
+	names, duration := criticalPath(commands, commandDurations(results), command.Name)
+	if len(names) > 0 {
+		fmt.Fprintf(w, "Critical path: %s (%v)\n", strings.Join(names, " -> "), duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "Total: %v, serial: %v\n", total.Round(time.Millisecond), serial.Round(time.Millisecond))
+}
+
+// traceEvent is a complete event in the Chrome trace event format.
+type traceEvent struct {
+	Name      string         `json:"name"`
+	Category  string         `json:"cat"`
+	Phase     string         `json:"ph"`
+	Timestamp int64          `json:"ts"`  // microseconds since the start of the invocation
+	Duration  int64          `json:"dur"` // microseconds
+	PID       int            `json:"pid"`
+	TID       int            `json:"tid"`
+	Args      map[string]any `json:"args,omitempty"`
+}
+
+/*
+traceEvents returns the executed commands and code blocks as trace events relative to start.
+Code blocks are nested in their commands, so they are shown as a flame chart by trace viewers
+like chrome://tracing or Perfetto. Secrets are masked in the arguments and errors.
+*/
+func traceEvents(state *runState, start time.Time) []traceEvent {
+	events := []traceEvent{}
+	for _, result := range state.getCommandResults() {
+		args := map[string]any{"file": result.command.Filename, "args": redactions.redactAll(result.args)}
+		if result.err != nil {
+			args["error"] = redactions.redact(result.err.Error())
+		}
+		events = append(events, traceEvent{
+			Name:      result.command.Name,
+			Category:  "command",
+			Phase:     "X",
+			Timestamp: result.start.Sub(start).Microseconds(),
+			Duration:  result.duration.Microseconds(),
+			PID:       1,
+			TID:       1,
+			Args:      args,
+		})
+	}
+	for _, result := range state.getResults() {
+		events = append(events, traceEvent{
+			Name:      fmt.Sprintf("%s:%d", result.codeBlock.Lang, result.codeBlock.Line),
+			Category:  "block",
+			Phase:     "X",
+			Timestamp: result.start.Sub(start).Microseconds(),
+			Duration:  result.duration.Microseconds(),
+			PID:       1,
+			TID:       1,
+			Args:      map[string]any{"command": result.command.Name, "file": result.command.Filename, "exit_code": result.exitCode},
+		})
+	}
+	return events
+}
+
+// writeTrace writes the executed commands and code blocks as Chrome trace event JSON to path.
+func writeTrace(path string, state *runState, start time.Time) error {
+	data, err := json.Marshal(map[string]any{"traceEvents": traceEvents(state, start), "displayTimeUnit": "ms"})
+	if err != nil {
+		return fmt.Errorf("failed to encode trace: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write trace: %w", err)
+	}
+	return nil
+}
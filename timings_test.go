@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCriticalPath(t *testing.T) {
+	commands := map[string]CommandBlock{
+		"fetch":   {Name: "fetch"},
+		"build":   {Name: "build", Dependencies: []string{"fetch"}},
+		"lint":    {Name: "lint"},
+		"release": {Name: "release", Dependencies: []string{"lint", "build"}},
+	}
+	durations := map[string]time.Duration{
+		"fetch":   2 * time.Second,
+		"build":   3 * time.Second,
+		"lint":    4 * time.Second,
+		"release": time.Second,
+	}
+
+	names, duration := criticalPath(commands, durations, "release")
+	if want := []string{"fetch", "build", "release"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("criticalPath() = %v, want %v", names, want)
+	}
+	if duration != 6*time.Second {
+		t.Errorf("criticalPath() duration = %v, want %v", duration, 6*time.Second)
+	}
+
+	// commands which were not executed are not part of the critical path
+	delete(durations, "release")
+	if names, _ := criticalPath(commands, durations, "release"); !reflect.DeepEqual(names, []string{"fetch", "build"}) {
+		t.Errorf("criticalPath() without release = %v", names)
+	}
+}
+
+func TestPrintTimingsAndTrace(t *testing.T) {
+	start := time.Now()
+	build := &CommandBlock{Name: "build", Filename: "build.md"}
+	codeBlock := &CodeBlock{Lang: "sh", Line: 5}
+	state := newRunState()
+	state.addResult(blockResult{command: build, codeBlock: codeBlock, start: start.Add(time.Millisecond), duration: 2 * time.Second})
+	state.addCommandResult(commandResult{command: build, start: start, duration: 2 * time.Second})
+
+	var out bytes.Buffer
+	printTimings(&out, map[string]CommandBlock{"build": *build}, build, state, 2*time.Second)
+	for _, want := range []string{"build", "sh:5", "2s", "100%", "Critical path: build (2s)", "Total: 2s, serial: 2s"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("printTimings() output does not contain %q:\n%s", want, out.String())
+		}
+	}
+
+	events := traceEvents(state, start)
+	if len(events) != 2 || events[0].Category != "command" || events[1].Name != "sh:5" || events[1].Timestamp != 1000 || events[1].Duration != 2000000 {
+		t.Errorf("traceEvents() = %+v", events)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileWatcher reports changed files in watched directories. Directories are not watched recursively.
+type fileWatcher interface {
+	add(dir string) error
+	events() <-chan string // paths of created, changed, deleted or moved files
+	close() error
+}
+
+// errFilesChanged is the cancellation cause of a run which is stopped because watched files changed.
+var errFilesChanged = errors.New("watched files changed")
+
+// globMeta are the characters with a special meaning in glob patterns.
+const globMeta = "*?[\\"
+
+/*
+matchGlob reports whether name matches pattern. Both are slash separated paths. In addition to the
+syntax of path.Match, a "**" segment matches any number of directories, e.g. "src/**" + "/*.go" matches
+all go files below src.
+*/
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+/*
+globRoot returns the directory to watch for the absolute glob pattern: the longest leading path without
+glob characters. The directory has to be watched recursively, if the rest of the pattern spans directories.
+*/
+func globRoot(pattern string) (string, bool) {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, globMeta) {
+			return filepath.FromSlash(strings.Join(segments[:i], "/")), i < len(segments)-1
+		}
+	}
+	return filepath.Dir(pattern), false
+}
+
+/*
+watchPatterns returns the absolute glob patterns of the files watched for command: its sources attribute
+and the sources of its dependencies, relative to their markdown files, the patterns given with --watch,
+relative to the working directory, and the markdown files defining the commands.
+*/
+func watchPatterns(commands map[string]CommandBlock, command *CommandBlock, globs []string, markdownFiles []string) ([]string, error) {
+	var patterns []string
+	add := func(pattern string, base string) {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(base, pattern)
+		}
+		patterns = append(patterns, filepath.Clean(pattern))
+	}
+
+	visited := make(map[string]bool)
+	var addSources func(command *CommandBlock) error
+	addSources = func(command *CommandBlock) error {
+		if visited[command.Name] {
+			return nil
+		}
+		visited[command.Name] = true
+		if sources, ok := metaString(command.Meta, "sources"); ok {
+			absFilename, err := filepath.Abs(command.Filename)
+			if err != nil {
+				return err
+			}
+			for _, source := range strings.Fields(sources) {
+				add(source, filepath.Dir(absFilename))
+			}
+		}
+		for _, dep := range command.Dependencies {
+			dependency, ok := commands[dep]
+			if !ok {
+				return fmt.Errorf("%w: %s", ErrDependencyNotFound, dep)
+			}
+			if err := addSources(&dependency); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := addSources(command); err != nil {
+		return nil, err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for _, glob := range globs {
+		add(glob, cwd)
+	}
+	for _, markdownFile := range markdownFiles {
+		add(markdownFile, cwd)
+	}
+	return patterns, nil
+}
+
+// watchedTree is a set of directories added to a fileWatcher.
+type watchedTree struct {
+	watcher   fileWatcher
+	dirs      map[string]bool
+	recursive []string // directories whose new subdirectories are watched as well
+}
+
+/*
+addTree watches dir and, if recursive, all of its subdirectories except hidden ones like .git.
+Missing directories are ignored, they might be created later.
+*/
+func (t *watchedTree) addTree(dir string, recursive bool) {
+	if recursive {
+		t.recursive = append(t.recursive, dir)
+	}
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !t.dirs[path] {
+			if err := t.watcher.add(path); err != nil {
+				logrus.Debug(fmt.Sprintf("Not watching '%s': %v", path, err))
+			}
+			t.dirs[path] = true
+		}
+		if !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// added handles a created path: new directories below recursively watched directories are watched as well.
+func (t *watchedTree) added(path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return
+	}
+	for _, root := range t.recursive {
+		if strings.HasPrefix(path, root+string(filepath.Separator)) {
+			t.addTree(path, true)
+			return
+		}
+	}
+}
+
+// matchesAny reports whether the path matches one of the absolute glob patterns.
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(filepath.ToSlash(pattern), filepath.ToSlash(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchOptions are the flags of mdx watch.
+type watchOptions struct {
+	globs    []string      // additional glob patterns of watched files
+	debounce time.Duration // time without further changes before the command is rerun
+	clear    bool          // clear the screen before every run
+}
+
+// watchBanner prints a status line of mdx watch to stderr.
+func watchBanner(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "[mdx watch] "+format+"\n", args...)
+}
+
+/*
+watchCommand executes the command and executes it again whenever a watched file changes, until mdx
+receives a signal. If files change while the command is running, it is stopped like on a timeout
+and started again. The markdown files are loaded again before every run, so changes of the command
+itself take effect.
+*/
+func watchCommand(ctx context.Context, markdownFiles []string, name string, args []string, options watchOptions) error {
+	watcher, err := newFileWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch files: %w", err)
+	}
+	defer watcher.close()
+	tree := &watchedTree{watcher: watcher, dirs: make(map[string]bool)}
+
+	var patterns []string
+	trigger := "start"
+	for {
+		commands := map[string]CommandBlock{}
+		var loadErr error
+		for _, markdownFile := range markdownFiles {
+			if loadErr = loadCommands(markdownFile, commands); loadErr != nil {
+				break
+			}
+		}
+		command, ok := commands[name]
+		if loadErr == nil && !ok {
+			loadErr = fmt.Errorf("command not found: %s", name)
+		}
+		if loadErr == nil {
+			if patterns, loadErr = watchPatterns(commands, &command, options.globs, markdownFiles); loadErr == nil {
+				for _, pattern := range patterns {
+					tree.addTree(globRoot(pattern))
+				}
+			}
+		}
+
+		// the escape sequence is written to stderr, so it does not end up in redirected output
+		if options.clear && isTerminal(os.Stderr) {
+			fmt.Fprint(os.Stderr, "\033[H\033[2J")
+		}
+		var done chan error
+		var cancelRun context.CancelCauseFunc
+		if loadErr != nil {
+			watchBanner("failed to load commands: %v, waiting for changes", loadErr)
+			for _, markdownFile := range markdownFiles {
+				absFile, _ := filepath.Abs(markdownFile)
+				patterns = append(patterns, absFile)
+				tree.addTree(filepath.Dir(absFile), false)
+			}
+		} else {
+			watchBanner("running %s (%s)", name, trigger)
+			var runCtx context.Context
+			runCtx, cancelRun = context.WithCancelCause(ctx)
+			done = make(chan error, 1)
+			start := time.Now()
+			go func() {
+				err := executeCommandBlock(runCtx, commands, &command, args...)
+				if err == nil {
+					watchBanner("%s succeeded in %v, waiting for changes", name, time.Since(start).Round(time.Millisecond))
+				} else if !errors.Is(err, errFilesChanged) && ctx.Err() == nil {
+					watchBanner("%s failed with exit status %d in %v: %v, waiting for changes", name, exitStatus(err), time.Since(start).Round(time.Millisecond), err)
+				}
+				done <- err
+			}()
+		}
+
+		changed, err := waitForChanges(ctx, watcher, tree, patterns, options.debounce, done)
+		if cancelRun != nil {
+			cancelRun(errFilesChanged)
+			if err := <-done; errors.Is(err, ErrInterrupted) && ctx.Err() == nil {
+				// the code block in the foreground received the interrupt instead of mdx
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		trigger = "changed: " + changed
+	}
+}
+
+/*
+waitForChanges waits until a file matching patterns changed and no further change happened for debounce,
+and returns the first changed file. It returns the cause of ctx once ctx is done. If the running command
+in done is interrupted by a signal, this is returned as well.
+*/
+func waitForChanges(ctx context.Context, watcher fileWatcher, tree *watchedTree, patterns []string, debounce time.Duration, done chan error) (string, error) {
+	var changed string
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return "", context.Cause(ctx)
+		case err := <-done:
+			done <- err
+			if errors.Is(err, ErrInterrupted) {
+				return "", err
+			}
+			done = nil
+		case path, ok := <-watcher.events():
+			if !ok {
+				return "", errors.New("file watcher stopped")
+			}
+			tree.added(path)
+			if !matchesAny(patterns, path) {
+				continue
+			}
+			logrus.Debug(fmt.Sprintf("Watched file changed: %s", path))
+			if changed == "" {
+				changed = path
+			}
+			settle = time.After(debounce)
+		case <-settle:
+			return changed, nil
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// globsFlag collects the values of the repeatable --watch flag.
+type globsFlag []string
+
+func (f *globsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *globsFlag) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask selects the inotify events which indicate a changed file.
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// inotifyWatcher watches directories with inotify.
+type inotifyWatcher struct {
+	mu      sync.Mutex
+	file    *os.File
+	dirs    map[int32]string
+	changes chan string
+}
+
+// newFileWatcher returns a fileWatcher using inotify.
+func newFileWatcher() (fileWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		// a non-blocking file is read with the runtime poller, so close interrupts a pending read
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int32]string),
+		changes: make(chan string, 64),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wd, err := unix.InotifyAddWatch(int(w.file.Fd()), dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+// read sends the paths of the changed files to the changes channel until the watcher is closed.
+func (w *inotifyWatcher) read() {
+	defer close(w.changes)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			w.mu.Lock()
+			dir, ok := w.dirs[event.Wd]
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.changes <- filepath.Join(dir, name)
+		}
+	}
+}
+
+func (w *inotifyWatcher) events() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,103 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pollInterval is the interval in which pollingWatcher scans the watched directories.
+const pollInterval = 500 * time.Millisecond
+
+// pollingWatcher watches directories by scanning them periodically, on platforms without inotify.
+type pollingWatcher struct {
+	mu      sync.Mutex
+	files   map[string]map[string]time.Time // modification times of the files, by directory and name
+	changes chan string
+	done    chan struct{}
+}
+
+// newFileWatcher returns a fileWatcher scanning the watched directories every pollInterval.
+func newFileWatcher() (fileWatcher, error) {
+	w := &pollingWatcher{
+		files:   make(map[string]map[string]time.Time),
+		changes: make(chan string, 64),
+		done:    make(chan struct{}),
+	}
+	go w.poll()
+	return w, nil
+}
+
+// scan returns the modification times of the files in dir.
+func scan(dir string) map[string]time.Time {
+	files := make(map[string]time.Time)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			files[entry.Name()] = info.ModTime()
+		}
+	}
+	return files
+}
+
+func (w *pollingWatcher) add(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files[dir] = scan(dir)
+	return nil
+}
+
+// poll compares the watched directories with their last scan and sends the paths of changed files.
+func (w *pollingWatcher) poll() {
+	defer close(w.changes)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		var changed []string
+		w.mu.Lock()
+		for dir, previous := range w.files {
+			current := scan(dir)
+			for name, modTime := range current {
+				if previousTime, ok := previous[name]; !ok || !previousTime.Equal(modTime) {
+					changed = append(changed, filepath.Join(dir, name))
+				}
+			}
+			for name := range previous {
+				if _, ok := current[name]; !ok {
+					changed = append(changed, filepath.Join(dir, name))
+				}
+			}
+			w.files[dir] = current
+		}
+		w.mu.Unlock()
+
+		for _, path := range changed {
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *pollingWatcher) events() <-chan string {
+	return w.changes
+}
+
+func (w *pollingWatcher) close() error {
+	close(w.done)
+	return nil
+}
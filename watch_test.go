@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"/src/*.go", "/src/main.go", true},
+		{"/src/*.go", "/src/pkg/main.go", false},
+		{"/src/**/*.go", "/src/main.go", true},
+		{"/src/**/*.go", "/src/pkg/deep/main.go", true},
+		{"/src/**/*.go", "/src/main.md", false},
+		{"/src/**", "/src/pkg/main.go", true},
+		{"/README.md", "/README.md", true},
+		{"/README.md", "/docs/README.md", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+	tests := []struct {
+		pattern       string
+		wantRoot      string
+		wantRecursive bool
+	}{
+		{"/repo/src/**/*.go", "/repo/src", true},
+		{"/repo/*.go", "/repo", false},
+		{"/repo/go.mod", "/repo", false},
+		{"/repo/cmd/*/main.go", "/repo/cmd", true},
+	}
+
+	for _, tt := range tests {
+		root, recursive := globRoot(tt.pattern)
+		if root != tt.wantRoot || recursive != tt.wantRecursive {
+			t.Errorf("globRoot(%q) = %q, %v, want %q, %v", tt.pattern, root, recursive, tt.wantRoot, tt.wantRecursive)
+		}
+	}
+}
+
+func TestWatchPatterns(t *testing.T) {
+	commands := map[string]CommandBlock{
+		"generate": {Name: "generate", Filename: "/repo/api/api.md", Meta: map[string]any{"sources": "api.yaml"}},
+		"build":    {Name: "build", Filename: "/repo/build.md", Dependencies: []string{"generate"}, Meta: map[string]any{"sources": "src/**/*.go go.mod"}},
+	}
+	command := commands["build"]
+
+	got, err := watchPatterns(commands, &command, []string{"/etc/app.conf"}, []string{"/repo/build.md"})
+	if err != nil {
+		t.Fatalf("watchPatterns() error = %v", err)
+	}
+	want := []string{"/repo/src/**/*.go", "/repo/go.mod", "/repo/api/api.yaml", "/etc/app.conf", "/repo/build.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("watchPatterns() = %v, want %v", got, want)
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := newFileWatcher()
+	if err != nil {
+		t.Fatalf("newFileWatcher() error = %v", err)
+	}
+	defer watcher.close()
+	if err := watcher.add(dir); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+
+	path := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(path, []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case changed := <-watcher.events():
+			if changed == path {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change of %s reported", path)
+		}
+	}
+}